@@ -0,0 +1,177 @@
+package insightops_logrus
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// QueueFullPolicy selects what Opts.Async does with an entry when its queue is full
+type QueueFullPolicy int
+
+const (
+	DropNewest QueueFullPolicy = iota // the entry being fired is dropped and counted in Stats
+	DropOldest                        // the longest queued entry is dropped and counted in Stats to make room
+	Block                             // Fire waits for room, as a synchronous hook would wait on the network
+)
+
+const defaultQueueSize = 1000
+
+// queuedLine is a formatted entry waiting for the background writer
+type queuedLine struct {
+	line  string
+	level logrus.Level
+}
+
+// startQueue creates the async queue and the background writer draining it
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) startQueue(size int, policy QueueFullPolicy) {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	hook.queue = make(chan queuedLine, size)
+	hook.queuePolicy = policy
+	hook.queueDone = make(chan struct{})
+	hook.queueClosing = make(chan struct{})
+	hook.queueCtx, hook.abandonQueue = context.WithCancel(context.Background())
+
+	go func() {
+		defer close(hook.queueDone)
+		defer hook.abandonQueue() // releases the context once the queue is done with
+		for queued := range hook.queue {
+			// once shutdown gives up on the queue, the rest is counted rather than written
+			if hook.queueCtx.Err() != nil {
+				hook.counters.droppedShutdown.Add(1)
+				continue
+			}
+			hook.deliverQueued(queued)
+		}
+	}()
+}
+
+// deliverQueued delivers a line taken off the queue. A panic from a callback is reported rather than stopping the
+// writer, which would leave the queue to fill up.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) deliverQueued(queued queuedLine) {
+	defer func() {
+		if r := recover(); r != nil {
+			hook.reportError(fmt.Errorf("recovered panic in insightops hook: %v", r))
+		}
+	}()
+	_ = hook.deliver(hook.queueCtx, queued.line, queued.level, time.Now())
+}
+
+// enqueue hands a formatted line to the background writer, applying the queue full policy. Block gives up, dropping
+// the line, when ctx is done or the queue is being closed.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) enqueue(ctx context.Context, line string, level logrus.Level) {
+	queued := queuedLine{line, level}
+
+	hook.queueMutex.RLock()
+	defer hook.queueMutex.RUnlock()
+
+	if hook.queueClosed {
+		hook.counters.droppedQueueFull.Add(1)
+		return
+	}
+
+	switch hook.queuePolicy {
+	case Block:
+		select {
+		case hook.queue <- queued:
+		case <-ctx.Done():
+			hook.counters.droppedQueueFull.Add(1)
+		case <-hook.queueClosing:
+			hook.counters.droppedQueueFull.Add(1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case hook.queue <- queued:
+				return
+			default:
+			}
+			select {
+			case <-hook.queue:
+				hook.counters.droppedQueueFull.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case hook.queue <- queued:
+		default:
+			hook.counters.droppedQueueFull.Add(1)
+		}
+	}
+}
+
+// DrainBuffered removes and returns the formatted lines that are batched or queued but not yet written, oldest first,
+// so they can be handed to a replacement hook or persisted. Each line ends in a newline and doesn't include the token.
+// Drained lines aren't counted in Stats. Fire waits while the queue is drained; a line the background writer has
+// already taken is still written.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) DrainBuffered() [][]byte {
+	var lines [][]byte
+	for _, queued := range hook.takeBatch() {
+		lines = append(lines, []byte(queued.line))
+	}
+	if hook.queue == nil {
+		return lines
+	}
+
+	hook.queueMutex.Lock()
+	defer hook.queueMutex.Unlock()
+	for {
+		select {
+		case queued, ok := <-hook.queue:
+			if !ok {
+				return lines
+			}
+			lines = append(lines, []byte(queued.line))
+		default:
+			return lines
+		}
+	}
+}
+
+// closeQueue stops accepting entries and waits for the background writer to deliver those already queued. Fires
+// blocked waiting for room under the Block policy give up, dropping their entries, rather than hold up closing. If ctx
+// is done first, the write in progress is cut short (and counted as failed) and the rest are dropped, returning how
+// many.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) closeQueue(ctx context.Context) (dropped int, err error) {
+	if hook.queue == nil {
+		return 0, nil
+	}
+
+	hook.queueClosingOnce.Do(func() { close(hook.queueClosing) })
+	hook.queueMutex.Lock()
+	if !hook.queueClosed {
+		hook.queueClosed = true
+		close(hook.queue)
+	}
+	hook.queueMutex.Unlock()
+
+	before := hook.counters.droppedShutdown.Load()
+	select {
+	case <-hook.queueDone:
+		// already delivered, e.g. when called again
+		return 0, nil
+	default:
+	}
+	select {
+	case <-hook.queueDone:
+		return 0, nil
+	case <-ctx.Done():
+		hook.abandonQueue()
+		<-hook.queueDone
+		return int(hook.counters.droppedShutdown.Load() - before), ctx.Err()
+	}
+}
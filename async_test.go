@@ -0,0 +1,289 @@
+package insightops_logrus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAsyncDeliversInOrder(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, Async: true})
+	logger := newTestLogger(hook)
+
+	for i := 0; i < 20; i++ {
+		logger.WithField("n", i).Info("queued")
+	}
+	hook.FlushAndClose()
+
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, float64(i), nextPayload(t, s)["n"])
+	}
+	assert.Zero(t, hook.Stats().DroppedQueueFull)
+}
+
+func TestAsyncQueueFullPolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy    QueueFullPolicy
+		delivered []string
+		dropped   uint64
+	}{
+		{DropNewest, []string{"1", "2", "3"}, 3},
+		{DropOldest, []string{"1", "5", "6"}, 3},
+		{Block, []string{"1", "2", "3", "4", "5", "6"}, 0},
+	} {
+		t.Run(strconv.Itoa(int(c.policy)), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			hook, err := NewWithConn("token ", client, &Opts{
+				Priority:        logrus.DebugLevel,
+				Async:           true,
+				QueueSize:       2,
+				QueueFullPolicy: c.policy,
+			})
+			require.NoError(t, err)
+
+			fire := func(msg string) {
+				require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: msg}))
+			}
+
+			// nothing reads the pipe yet, so the writer stalls on the first entry and the rest queue up
+			fire("1")
+			require.Eventually(t, func() bool { return len(hook.queue) == 0 }, time.Second, time.Millisecond)
+			fire("2")
+			fire("3")
+
+			fired := make(chan struct{})
+			go func() {
+				defer close(fired)
+				fire("4")
+				fire("5")
+				fire("6")
+			}()
+			if c.policy != Block {
+				<-fired
+				assert.Equal(t, c.dropped, hook.Stats().DroppedQueueFull)
+			}
+
+			lines := make(chan string, 10)
+			go func() {
+				defer close(lines)
+				scanner := bufio.NewScanner(server)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+			<-fired
+			hook.FlushAndClose()
+			require.NoError(t, client.Close())
+
+			var delivered []string
+			for line := range lines {
+				var payload struct{ Msg string }
+				require.NoError(t, json.Unmarshal([]byte(line[len("token "):]), &payload))
+				delivered = append(delivered, payload.Msg)
+			}
+			assert.Equal(t, c.delivered, delivered)
+			assert.Equal(t, c.dropped, hook.Stats().DroppedQueueFull)
+		})
+	}
+}
+
+func TestFlushAndCloseContext(t *testing.T) {
+	// newStalledHook returns an async hook writing to a pipe that isn't read until read is called
+	newStalledHook := func(t *testing.T) (hook *InsightOpsHook, read func() []string) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = server.Close() })
+		hook, err := NewWithConn("token ", client, &Opts{Priority: logrus.DebugLevel, Async: true, OnError: func(error) {}})
+		require.NoError(t, err)
+
+		lines := make(chan string, 100)
+		read = func() []string {
+			go func() {
+				scanner := bufio.NewScanner(server)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+			var received []string
+			for {
+				select {
+				case line := <-lines:
+					received = append(received, line)
+				case <-time.After(100 * time.Millisecond):
+					return received
+				}
+			}
+		}
+		for i := 0; i < 10; i++ {
+			require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: strconv.Itoa(i)}))
+		}
+		return hook, read
+	}
+
+	t.Run("enough time", func(t *testing.T) {
+		hook, read := newStalledHook(t)
+		received := make(chan []string)
+		go func() { received <- read() }()
+
+		dropped, err := hook.FlushAndCloseContext(context.Background())
+		require.NoError(t, err)
+		assert.Zero(t, dropped)
+		assert.Len(t, <-received, 10)
+		assert.Zero(t, hook.Stats().DroppedShutdown)
+	})
+
+	t.Run("tight deadline", func(t *testing.T) {
+		hook, _ := newStalledHook(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		// the first entry is stuck being written, so it's cut short and the other nine are dropped
+		dropped, err := hook.FlushAndCloseContext(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 9, dropped)
+		assert.Equal(t, uint64(9), hook.Stats().DroppedShutdown)
+		assert.Equal(t, uint64(1), hook.Stats().Failed)
+
+		dropped, err = hook.FlushAndCloseContext(ctx)
+		assert.NoError(t, err, "closing again does nothing")
+		assert.Zero(t, dropped)
+	})
+}
+
+func TestDrainBuffered(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	hook, err := NewWithConn("token ", client, &Opts{Priority: logrus.DebugLevel, Async: true})
+	require.NoError(t, err)
+
+	fire := func(msg string) {
+		require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: msg}))
+	}
+
+	// nothing reads the pipe yet, so the writer stalls on the first entry and the rest stay queued
+	fire("1")
+	require.Eventually(t, func() bool { return len(hook.queue) == 0 }, time.Second, time.Millisecond)
+	for i := 2; i <= 5; i++ {
+		fire(strconv.Itoa(i))
+	}
+
+	var drained []string
+	for _, line := range hook.DrainBuffered() {
+		require.Equal(t, byte('\n'), line[len(line)-1])
+		var payload struct{ Msg string }
+		require.NoError(t, json.Unmarshal(line, &payload))
+		drained = append(drained, payload.Msg)
+	}
+	assert.Equal(t, []string{"2", "3", "4", "5"}, drained)
+	assert.Empty(t, hook.queue)
+	assert.Empty(t, hook.DrainBuffered())
+
+	// the hook keeps working, and the drained entries are never written
+	fire("6")
+	lines := make(chan string, 10)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	hook.FlushAndClose()
+	require.NoError(t, client.Close())
+
+	var delivered []string
+	for line := range lines {
+		var payload struct{ Msg string }
+		require.NoError(t, json.Unmarshal([]byte(line[len("token "):]), &payload))
+		delivered = append(delivered, payload.Msg)
+	}
+	assert.Equal(t, []string{"1", "6"}, delivered)
+}
+
+func TestAsyncBlockHonoursContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	hook, err := NewWithConn("token ", client, &Opts{
+		Priority:        logrus.DebugLevel,
+		Async:           true,
+		QueueSize:       1,
+		QueueFullPolicy: Block,
+		OnError:         func(error) {},
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndCloseContext(context.Background())
+	entry := func(msg string) *logrus.Entry {
+		return &logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: msg}
+	}
+
+	// nothing reads the pipe, so the writer stalls on the first entry and the second fills the queue
+	require.NoError(t, hook.Fire(entry("1")))
+	require.Eventually(t, func() bool { return len(hook.queue) == 0 }, time.Second, time.Millisecond)
+	require.NoError(t, hook.Fire(entry("2")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, hook.FireCtx(ctx, entry("3")))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("FireCtx kept blocking on a full queue after its context was done")
+	}
+	assert.Equal(t, uint64(1), hook.Stats().DroppedQueueFull)
+
+	// let the writer finish so the hook can close
+	require.NoError(t, client.Close())
+}
+
+func TestAsyncCloseReleasesBlockedFires(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	hook, err := NewWithConn("token ", client, &Opts{
+		Priority:        logrus.DebugLevel,
+		Async:           true,
+		QueueSize:       1,
+		QueueFullPolicy: Block,
+		WriteTimeout:    time.Second,
+		OnError:         func(error) {},
+	})
+	require.NoError(t, err)
+	entry := func(msg string) *logrus.Entry {
+		return &logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: msg}
+	}
+
+	// nothing reads the pipe, so the writer stalls on the first entry, the second fills the queue and the rest block
+	require.NoError(t, hook.Fire(entry("1")))
+	require.Eventually(t, func() bool { return len(hook.queue) == 0 }, time.Second, time.Millisecond)
+	require.NoError(t, hook.Fire(entry("2")))
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, hook.Fire(entry("blocked")))
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = hook.FlushAndCloseContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "blocked Fires held up closing")
+	wg.Wait()
+	assert.Equal(t, uint64(6), hook.Stats().DroppedQueueFull)
+}
@@ -0,0 +1,82 @@
+package insightops_logrus
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrBackingOff is returned by dials skipped because an earlier one failed too recently, see Opts.Backoff
+var ErrBackingOff = errors.New("insightops: backing off after failed connection attempts")
+
+// Backoff spaces out dials to an endpoint that's down, rather than every Fire dialing it straight away.
+// The wait starts at Initial after a failed dial and is multiplied by Multiplier after every further failure, up to
+// Max; a successful dial resets it.
+type Backoff struct {
+	Initial    time.Duration // defaults to 100ms
+	Max        time.Duration // defaults to 30s
+	Multiplier float64       // defaults to 2
+	Jitter     float64       // fraction of each wait randomly added or removed, e.g. 0.2 for ±20%, so hooks don't dial in step
+}
+
+const (
+	defaultBackoffInitial    = 100 * time.Millisecond
+	defaultBackoffMax        = 30 * time.Second
+	defaultBackoffMultiplier = 2
+)
+
+// backoff tracks when the next dial may be attempted
+type backoff struct {
+	Backoff
+
+	mu      sync.Mutex
+	delay   time.Duration // the last wait before jitter, zero while dials succeed
+	retryAt time.Time
+}
+
+func newBackoff(config Backoff) *backoff {
+	if config.Initial <= 0 {
+		config.Initial = defaultBackoffInitial
+	}
+	if config.Max <= 0 {
+		config.Max = defaultBackoffMax
+	}
+	if config.Multiplier < 1 {
+		config.Multiplier = defaultBackoffMultiplier
+	}
+	return &backoff{Backoff: config}
+}
+
+// remaining returns how long until the next dial may be attempted
+func (b *backoff) remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Until(b.retryAt)
+}
+
+// failed records a failed dial, returning the wait before the next one
+func (b *backoff) failed() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.delay == 0 {
+		b.delay = b.Initial
+	} else {
+		b.delay = min(time.Duration(float64(b.delay)*b.Multiplier), b.Max)
+	}
+	wait := b.delay
+	if b.Jitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * b.Jitter * float64(wait))
+	}
+	b.retryAt = time.Now().Add(wait)
+	return wait
+}
+
+// succeeded records a successful dial, resetting the wait
+func (b *backoff) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.delay = 0
+	b.retryAt = time.Time{}
+}
@@ -0,0 +1,98 @@
+package insightops_logrus
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowsAndCaps(t *testing.T) {
+	b := newBackoff(Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2})
+
+	var waits []time.Duration
+	for i := 0; i < 5; i++ {
+		waits = append(waits, b.failed())
+	}
+	assert.Equal(t, []time.Duration{10, 20, 40, 50, 50}, scale(waits, time.Millisecond))
+	assert.Greater(t, b.remaining(), time.Duration(0))
+
+	b.succeeded()
+	assert.LessOrEqual(t, b.remaining(), time.Duration(0))
+	assert.Equal(t, 10*time.Millisecond, b.failed())
+
+	jittered := newBackoff(Backoff{Initial: 100 * time.Millisecond, Jitter: 0.2})
+	for i := 0; i < 20; i++ {
+		jittered.succeeded()
+		wait := jittered.failed()
+		assert.GreaterOrEqual(t, wait, 80*time.Millisecond)
+		assert.LessOrEqual(t, wait, 120*time.Millisecond)
+	}
+}
+
+// scale expresses durations in units of unit
+func scale(durations []time.Duration, unit time.Duration) []time.Duration {
+	scaled := make([]time.Duration, len(durations))
+	for i, d := range durations {
+		scaled[i] = d / unit
+	}
+	return scaled
+}
+
+func TestBackoffGatesDials(t *testing.T) {
+	// find a free port, then leave it closed so dials are refused
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	hook := newHook("token ")
+	hook.network, hook.host = "tcp", "127.0.0.1"
+	_, port, _ := net.SplitHostPort(address)
+	hook.port, _ = strconv.Atoi(port)
+	hook.backoff = newBackoff(Backoff{Initial: 50 * time.Millisecond})
+	defer hook.FlushAndClose()
+
+	_, err = hook.netConnect()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrBackingOff)
+
+	// the next dial is skipped rather than attempted
+	_, err = hook.netConnect()
+	assert.ErrorIs(t, err, ErrBackingOff)
+
+	s := newLineServerAt(t, address, nil)
+	require.Eventually(t, func() bool {
+		conn, err := hook.netConnect()
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return s.Accepted() == 1 }, time.Second, time.Millisecond)
+	assert.LessOrEqual(t, hook.backoff.remaining(), time.Duration(0))
+}
+
+func TestBackoffIgnoresCancelledDials(t *testing.T) {
+	dialer := newPipeDialer()
+	hook := newHook("token ")
+	hook.connDialer = dialer
+	hook.backoff = newBackoff(Backoff{Initial: time.Minute})
+	defer hook.FlushAndClose()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dialer.err = context.Canceled
+	_, err := hook.connect(ctx, time.Time{})
+	require.ErrorIs(t, err, context.Canceled)
+
+	// the endpoint wasn't at fault, so the next dial goes ahead
+	dialer.err = nil
+	conn, err := hook.netConnect()
+	require.NoError(t, err)
+	_ = conn.Close()
+}
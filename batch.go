@@ -0,0 +1,190 @@
+package insightops_logrus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+const defaultBatchFlushInterval = time.Second
+
+// batchFlushReason is why a batch was written, counted in Stats
+type batchFlushReason int
+
+const (
+	flushedBySize batchFlushReason = iota
+	flushedByInterval
+	flushedByShutdown
+	flushedByMemPressure
+	batchFlushReasons // the number of reasons, sizing the counters
+)
+
+// addToBatch adds a formatted line to the current batch, writing the batch when it's full, bounded by ctx and by
+// deadline (if not zero). A new batch starts the timer that writes it if it doesn't fill in time.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) addToBatch(ctx context.Context, line string, level logrus.Level, deadline time.Time) error {
+	hook.batchMutex.Lock()
+	if hook.batchClosed {
+		hook.batchMutex.Unlock()
+		return ErrHookClosed
+	}
+	hook.batch = append(hook.batch, queuedLine{line, level})
+	full := len(hook.batch) >= hook.batchSize
+	if !full && hook.batchTimer == nil {
+		hook.batchTimer = time.AfterFunc(hook.batchInterval, func() { hook.flushBatchInBackground(flushedByInterval) })
+	}
+	hook.batchMutex.Unlock()
+
+	if full {
+		_, err := hook.flushBatch(ctx, deadline, flushedBySize)
+		return err
+	}
+	return nil
+}
+
+// closeBatch stops addToBatch accepting entries, so the final flush at shutdown doesn't race with a new batch
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) closeBatch() {
+	hook.batchMutex.Lock()
+	defer hook.batchMutex.Unlock()
+	hook.batchClosed = true
+}
+
+// flushBatch writes the current batch, if any, for reason in a single write bounded by ctx and by deadline (if not
+// zero), and reports the outcome for all of its entries, returning how many were lost when it fails. Only taking and writing the batch happen under flushMutex; callbacks run after it's released, so a slow OnError or
+// OnBatchDelivered doesn't hold up later batches.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) flushBatch(ctx context.Context, deadline time.Time, reason batchFlushReason) (failed int, err error) {
+	batch, data, err := hook.writeBatch(ctx, deadline, reason)
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	if err != nil {
+		hook.reportError(fmt.Errorf("unable to write batch of %d entries to conn | err: %w", len(batch), err))
+		lines := make([]string, len(batch))
+		for i, queued := range batch {
+			lines[i] = queued.line
+		}
+		if hook.writeFallback(err, lines...) {
+			return 0, nil
+		}
+		return len(batch), err
+	}
+	if hook.onDelivered != nil {
+		hook.onDelivered(len(batch), buffersLen(data))
+	}
+	return 0, nil
+}
+
+// flushBatchInBackground is flushBatch for flushes no Fire waits on, such as a batch that didn't fill in time. It runs
+// on a goroutine of its own, so a panic from a callback is reported rather than taking the process down.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) flushBatchInBackground(reason batchFlushReason) {
+	defer func() {
+		if r := recover(); r != nil {
+			hook.reportError(fmt.Errorf("recovered panic in insightops hook: %v", r))
+		}
+	}()
+	_, _ = hook.flushBatch(context.Background(), time.Time{}, reason)
+}
+
+// writeBatch takes the current batch and writes it under flushMutex, so batches go out in order, counting the batch
+// and the outcome. The lines are copied into a single buffer, unless Opts.BatchWritev leaves each in a buffer of its
+// own for writeConn to hand to writev.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) writeBatch(ctx context.Context, deadline time.Time, reason batchFlushReason) (batch []queuedLine, data net.Buffers, err error) {
+	hook.flushMutex.Lock()
+	defer hook.flushMutex.Unlock()
+
+	if batch = hook.takeBatch(); len(batch) == 0 {
+		return nil, nil, nil
+	}
+	if hook.batchWritev {
+		token := []byte(hook.token)
+		data = make(net.Buffers, 0, 2*len(batch))
+		for _, queued := range batch {
+			data = append(data, token, []byte(queued.line))
+		}
+	} else {
+		var joined []byte
+		for _, queued := range batch {
+			joined = append(joined, hook.token...)
+			joined = append(joined, queued.line...)
+		}
+		data = net.Buffers{joined}
+	}
+	size := buffersLen(data)
+	hook.counters.batchFlushed(reason, len(batch), size)
+	if err = hook.writeData(ctx, data, deadline); err != nil {
+		hook.counters.failed.Add(uint64(len(batch)))
+		return batch, data, err
+	}
+	hook.counters.sent.Add(uint64(len(batch)))
+	hook.counters.bytesWritten.Add(uint64(size))
+	for _, queued := range batch {
+		hook.counters.shipped(queued.level)
+	}
+	return batch, data, nil
+}
+
+// takeBatch empties the current batch, returning what it held
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) takeBatch() []queuedLine {
+	hook.batchMutex.Lock()
+	defer hook.batchMutex.Unlock()
+
+	batch := hook.batch
+	hook.batch = nil
+	if hook.batchTimer != nil {
+		hook.batchTimer.Stop()
+		hook.batchTimer = nil
+	}
+	return batch
+}
+
+// writeBuffers writes data to conn. Several buffers go out in a single writev where conn is a plain tcp or unix
+// connection, and are otherwise joined into one Write, so that a tls connection doesn't send a record per buffer.
+func writeBuffers(conn net.Conn, data net.Buffers) error {
+	if len(data) == 1 {
+		_, err := conn.Write(data[0])
+		return err
+	}
+	if limited, ok := conn.(*limitedConn); ok {
+		conn = limited.Conn
+	}
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		// WriteTo consumes the buffers it's given, which a retry needs intact
+		buffers := append(net.Buffers(nil), data...)
+		_, err := buffers.WriteTo(conn)
+		return err
+	}
+	_, err := conn.Write(joinBuffers(data))
+	return err
+}
+
+// joinBuffers returns data as a single slice, without copying when it's already one
+func joinBuffers(data net.Buffers) []byte {
+	if len(data) == 1 {
+		return data[0]
+	}
+	return bytes.Join(data, nil)
+}
+
+// buffersLen returns the total length of data
+func buffersLen(data net.Buffers) (n int) {
+	for _, b := range data {
+		n += len(b)
+	}
+	return
+}
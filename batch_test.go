@@ -0,0 +1,323 @@
+package insightops_logrus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingConn counts the writes made to it
+type countingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+func TestBatching(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &countingConn{Conn: client}
+	hook, err := NewWithConn("token ", conn, &Opts{
+		Priority:           logrus.DebugLevel,
+		BatchSize:          4,
+		BatchFlushInterval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	lines := make(chan string, 20)
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	next := func() string {
+		select {
+		case line := <-lines:
+			require.Equal(t, "token ", line[:len("token ")])
+			var payload struct{ Msg string }
+			require.NoError(t, json.Unmarshal([]byte(line[len("token "):]), &payload))
+			return payload.Msg
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a line")
+			return ""
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: strconv.Itoa(i)}))
+	}
+	// two full batches are written straight away, the rest once the flush interval passes
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, strconv.Itoa(i), next())
+	}
+	assert.Equal(t, int32(3), conn.writes.Load())
+	assert.Eventually(t, func() bool { return hook.Stats().Sent == 10 }, time.Second, time.Millisecond)
+
+	// a partial batch is flushed on close
+	require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "last"}))
+	go hook.FlushAndClose()
+	assert.Equal(t, "last", next())
+}
+
+func TestBatchCallbacksDontHoldUpFlushes(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+		}
+	}()
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	var calls atomic.Int32
+	hook, err := NewWithConn("token ", client, &Opts{
+		Priority:  logrus.DebugLevel,
+		BatchSize: 2,
+		OnBatchDelivered: func(count int, bytes int) {
+			if calls.Add(1) == 1 {
+				close(entered)
+				<-release
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+	defer close(release)
+
+	fire := func(msg string) error {
+		return hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: msg})
+	}
+	go func() {
+		_ = fire("1")
+		_ = fire("2")
+	}()
+	<-entered
+
+	// the first batch's callback is stuck, but the next batch is still written
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, fire("3"))
+		assert.NoError(t, fire("4"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a slow OnBatchDelivered held up the next batch")
+	}
+	assert.Equal(t, uint64(4), hook.Stats().Sent)
+}
+
+func TestBatchTimerRecoversPanic(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+		}
+	}()
+
+	errs := make(chan error, 10)
+	hook, err := NewWithConn("token ", client, &Opts{
+		Priority:           logrus.DebugLevel,
+		BatchSize:          10,
+		BatchFlushInterval: 10 * time.Millisecond,
+		OnBatchDelivered:   func(int, int) { panic("boom") },
+		OnError:            func(err error) { errs <- err },
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+
+	require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "one"}))
+	select {
+	case err := <-errs:
+		assert.ErrorContains(t, err, "boom")
+	case <-time.After(time.Second):
+		t.Fatal("the timer's flush didn't report the panic")
+	}
+	assert.Equal(t, uint64(1), hook.Stats().Sent)
+}
+
+func TestBatchFinalFlushHonoursContext(t *testing.T) {
+	// nothing reads from the other end, so writes hang until cut short
+	client, server := net.Pipe()
+	defer server.Close()
+	hook, err := NewWithConn("token ", client, &Opts{
+		Priority:     logrus.DebugLevel,
+		BatchSize:    10,
+		WriteTimeout: 2 * time.Second,
+		OnError:      func(error) {},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "one"}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	dropped, err := hook.FlushAndCloseContext(ctx)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Error(t, err)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, uint64(1), hook.Stats().Failed)
+
+	// once closed, entries aren't batched to fail later
+	assert.ErrorIs(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "two"}), ErrHookClosed)
+}
+
+func TestBatchFlushHonoursFireContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	hook, err := NewWithConn("token ", client, &Opts{
+		Priority:     logrus.DebugLevel,
+		BatchSize:    2,
+		WriteTimeout: 2 * time.Second,
+		OnError:      func(error) {},
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, hook.FireCtx(ctx, &logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "one"}))
+	start := time.Now()
+	err = hook.FireCtx(ctx, &logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "two"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, uint64(2), hook.Stats().Failed)
+}
+
+func TestBatchStats(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+		}
+	}()
+	hook, err := NewWithConn("token ", client, &Opts{
+		Priority:           logrus.DebugLevel,
+		BatchSize:          3,
+		BatchFlushInterval: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	fire := func(n int) {
+		for i := 0; i < n; i++ {
+			require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: strconv.Itoa(i)}))
+		}
+	}
+
+	// two full batches, then one left for the interval
+	fire(7)
+	require.Eventually(t, func() bool { return hook.Stats().BatchesFlushed == 3 }, time.Second, time.Millisecond)
+	// two left for shutdown
+	fire(2)
+	hook.FlushAndClose()
+
+	stats := hook.Stats()
+	assert.Equal(t, uint64(4), stats.BatchesFlushed)
+	assert.Equal(t, uint64(9), stats.BatchedEntries)
+	assert.Equal(t, stats.BytesWritten, stats.BatchedBytes)
+	assert.Equal(t, uint64(2), stats.BatchFlushesBySize)
+	assert.Equal(t, uint64(1), stats.BatchFlushesByInterval)
+	assert.Equal(t, uint64(1), stats.BatchFlushesByShutdown)
+	assert.Equal(t, uint64(0), stats.BatchFlushesByMemPressure)
+	assert.Equal(t, map[int]uint64{1: 1, 2: 1, 3: 2}, hook.BatchSizeCounts())
+}
+
+func TestBatchWritev(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, BatchSize: 10, BatchWritev: true})
+	logger := newTestLogger(hook)
+
+	for i := 0; i < 30; i++ {
+		logger.Info(strconv.Itoa(i))
+	}
+	for i := 0; i < 30; i++ {
+		assert.Equal(t, strconv.Itoa(i), nextPayload(t, s)["msg"])
+	}
+	assert.Equal(t, uint64(3), hook.Stats().BatchFlushesBySize)
+}
+
+func TestWriteBuffersLeavesBuffersIntact(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	data := net.Buffers{[]byte("token "), []byte("one\n"), []byte("token "), []byte("two\n")}
+	require.NoError(t, writeBuffers(conn, data))
+	require.NoError(t, conn.Close())
+
+	assert.Equal(t, "token one\ntoken two\n", <-received)
+	assert.Equal(t, net.Buffers{[]byte("token "), []byte("one\n"), []byte("token "), []byte("two\n")}, data, "kept for a retry")
+}
+
+// benchmarkBatchWrite writes batches of 1000 lines to a tcp connection that's read and discarded, joined into one
+// buffer or handed to writev
+func benchmarkBatchWrite(b *testing.B, writev bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(b, err)
+	defer conn.Close()
+
+	token := []byte("00000000-0000-0000-0000-000000000000 ")
+	line := []byte(`{"level":"info","msg":"` + strings.Repeat("x", 200) + `"}` + "\n")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var data net.Buffers
+		if writev {
+			for j := 0; j < 1000; j++ {
+				data = append(data, token, line)
+			}
+		} else {
+			var joined []byte
+			for j := 0; j < 1000; j++ {
+				joined = append(joined, token...)
+				joined = append(joined, line...)
+			}
+			data = net.Buffers{joined}
+		}
+		if err := writeBuffers(conn, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBatchWriteJoined(b *testing.B) { benchmarkBatchWrite(b, false) }
+
+func BenchmarkBatchWriteWritev(b *testing.B) { benchmarkBatchWrite(b, true) }
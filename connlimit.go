@@ -0,0 +1,61 @@
+package insightops_logrus
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrTooManyConnections is returned by dials while the process-wide cap set by SetMaxTotalConnections is reached
+var ErrTooManyConnections = errors.New("insightops: maximum total connections reached")
+
+// connLimit caps the connections open across all hooks in the process
+var connLimit struct {
+	sync.Mutex
+	max  int
+	open int
+}
+
+// SetMaxTotalConnections caps how many connections all hooks in the process may have open at once, to protect against
+// file descriptor exhaustion. Dials fail fast with ErrTooManyConnections while the cap is reached.
+// n <= 0 removes the cap (the default). Connections already open are unaffected.
+func SetMaxTotalConnections(n int) {
+	connLimit.Lock()
+	defer connLimit.Unlock()
+	connLimit.max = n
+}
+
+// acquireConnSlot reserves a slot for a new connection, reporting whether one was available and whether it needs
+// releasing (no cap means nothing was reserved)
+func acquireConnSlot() (ok bool, reserved bool) {
+	connLimit.Lock()
+	defer connLimit.Unlock()
+	if connLimit.max <= 0 {
+		return true, false
+	}
+	if connLimit.open >= connLimit.max {
+		return false, false
+	}
+	connLimit.open++
+	return true, true
+}
+
+// releaseConnSlot frees a slot reserved by acquireConnSlot
+func releaseConnSlot() {
+	connLimit.Lock()
+	defer connLimit.Unlock()
+	if connLimit.open > 0 {
+		connLimit.open--
+	}
+}
+
+// limitedConn releases its connection slot when closed
+type limitedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(releaseConnSlot)
+	return c.Conn.Close()
+}
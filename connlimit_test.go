@@ -0,0 +1,71 @@
+package insightops_logrus
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestMaxTotalConnectionsAcrossHooks(t *testing.T) {
+	SetMaxTotalConnections(2)
+	t.Cleanup(func() { SetMaxTotalConnections(0) })
+
+	s := newLineServer(t, nil)
+	first := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel})
+	second := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel})
+
+	a, err := first.netConnect()
+	require.NoError(t, err)
+	b, err := second.netConnect()
+	require.NoError(t, err)
+
+	_, err = first.netConnect()
+	assert.ErrorIs(t, err, ErrTooManyConnections)
+	_, err = second.netConnect()
+	assert.ErrorIs(t, err, ErrTooManyConnections)
+
+	// closing frees the slot, and closing twice doesn't free it twice
+	require.NoError(t, a.Close())
+	_ = a.Close()
+	c, err := second.netConnect()
+	require.NoError(t, err)
+	_, err = first.netConnect()
+	assert.ErrorIs(t, err, ErrTooManyConnections)
+
+	require.NoError(t, b.Close())
+	require.NoError(t, c.Close())
+
+	// removing the cap allows dials again
+	SetMaxTotalConnections(0)
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := first.netConnect()
+		require.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+func TestPingCountsAgainstMaxTotalConnections(t *testing.T) {
+	SetMaxTotalConnections(1)
+	t.Cleanup(func() { SetMaxTotalConnections(0) })
+
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel})
+
+	conn, err := hook.netConnect()
+	require.NoError(t, err)
+	assert.ErrorIs(t, hook.Ping(context.Background()), ErrTooManyConnections)
+	require.NoError(t, conn.Close())
+
+	// the ping's slot is freed once it's done with
+	require.NoError(t, hook.Ping(context.Background()))
+	conn, err = hook.netConnect()
+	require.NoError(t, err)
+	_ = conn.Close()
+}
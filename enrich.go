@@ -0,0 +1,174 @@
+package insightops_logrus
+
+import (
+	"bytes"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Stage is one step of entry enrichment, run on a copy of the entry before it's formatted
+type Stage int
+
+const (
+	StageTags             Stage = iota // adds AutoTags, AddBootID and AddRegionField fields the entry doesn't already carry
+	StageTimestamp                     // converts the entry time to Opts.TimestampLocation, keeping Opts.OriginalTimestampField
+	StageEventID                       // adds the Opts.AddEventID field
+	StageRequiredFields                // marks missing required fields when Opts.RequiredFieldsPolicy is MarkMissingRequired
+	StageByteSlices                    // renders []byte values per Opts.ByteSliceEncoding
+	StageCollapseNewlines              // replaces newlines in string values per Opts.CollapseNewlines
+	StageOmitEmpty                     // strips empty values per Opts.OmitEmpty
+	StageNest                          // nests all fields per Opts.NestFieldsUnder
+	StageGoroutineID                   // adds the id of the goroutine firing the entry per Opts.AddGoroutineID
+	StageErrorClass                    // adds the Opts.ErrorClassifier result to Error level and above entries
+	StageMessageLines                  // truncates the message per Opts.MaxMessageLines
+)
+
+// DefaultEnrichmentPipeline is the order stages run in unless Opts.EnrichmentPipeline says otherwise.
+// Fields are added first so later stages see them, value rewrites follow, and nesting comes last as it moves every
+// field under one key.
+var DefaultEnrichmentPipeline = []Stage{
+	StageTags,
+	StageTimestamp,
+	StageEventID,
+	StageGoroutineID,
+	StageErrorClass,
+	StageRequiredFields,
+	StageByteSlices,
+	StageCollapseNewlines,
+	StageOmitEmpty,
+	StageMessageLines,
+	StageNest,
+}
+
+// errDroppedByTransform is returned by format for entries Opts.TransformEntry drops
+var errDroppedByTransform = errors.New("insightops: entry dropped by TransformEntry")
+
+// prepare returns a copy of entry with the hook's enrichment applied, leaving the original untouched for other hooks,
+// or nil when Opts.TransformEntry drops it.
+// Redaction isn't a stage, so a custom pipeline can't leave it out, and runs first so no stage sees a secret.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) prepare(entry *logrus.Entry) *logrus.Entry {
+	entry = cloneEntry(entry)
+	hook.redact(entry)
+	for _, stage := range hook.pipeline {
+		hook.applyStage(stage, entry)
+	}
+	if hook.transformEntry != nil {
+		entry = hook.transformEntry(entry)
+	}
+	return entry
+}
+
+// applyStage runs a single enrichment stage on entry, which must already be a copy
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) applyStage(stage Stage, entry *logrus.Entry) {
+	switch stage {
+	case StageTags:
+		for k, v := range hook.tags {
+			if _, ok := entry.Data[k]; !ok {
+				entry.Data[k] = v
+			}
+		}
+
+	case StageTimestamp:
+		if hook.originalTimestampField != "" {
+			entry.Data[hook.originalTimestampField] = entry.Time.Format(time.RFC3339Nano)
+		}
+		entry.Time = entry.Time.In(hook.timestampLocation)
+
+	case StageEventID:
+		// the id is generated once per entry and is part of the formatted line, so every retry of that line carries it
+		if hook.eventIDField != "" {
+			if id, err := newUUID(); err == nil {
+				entry.Data[hook.eventIDField] = id
+			}
+		}
+
+	case StageGoroutineID:
+		if hook.addGoroutineID {
+			entry.Data[goroutineIDField] = goroutineID()
+		}
+
+	case StageErrorClass:
+		if hook.errorClassifier != nil && entry.Level <= logrus.ErrorLevel {
+			if class := hook.errorClassifier(entry); class != "" {
+				entry.Data[hook.errorClassField] = class
+			}
+		}
+
+	case StageRequiredFields:
+		if hook.requiredFieldsPolicy == MarkMissingRequired {
+			if missing := hook.missingRequired(entry); len(missing) > 0 {
+				entry.Data[missingRequiredKey] = missing
+			}
+		}
+
+	case StageByteSlices:
+		if hook.byteSlices != ByteSliceBase64 {
+			for k, v := range entry.Data {
+				if b, ok := v.([]byte); ok {
+					entry.Data[k] = hook.byteSlices.encode(b, hook.bytePreviewLen)
+				}
+			}
+		}
+
+	case StageCollapseNewlines:
+		if hook.newlineToken != "" {
+			for k, v := range entry.Data {
+				switch v := v.(type) {
+				case string:
+					entry.Data[k] = collapseNewlines(v, hook.newlineToken)
+				case error:
+					entry.Data[k] = collapseNewlines(v.Error(), hook.newlineToken)
+				}
+			}
+		}
+
+	case StageOmitEmpty:
+		if hook.omitEmpty != 0 {
+			for k, v := range entry.Data {
+				if hook.omitEmpty.matches(v) {
+					delete(entry.Data, k)
+				}
+			}
+		}
+
+	case StageMessageLines:
+		if hook.maxMessageLines > 0 {
+			entry.Message = truncateLines(entry.Message, hook.maxMessageLines)
+		}
+
+	case StageNest:
+		if hook.nestFieldsUnder != "" && len(entry.Data) > 0 {
+			nested := make(logrus.Fields, len(entry.Data))
+			for k, v := range entry.Data {
+				if err, ok := v.(error); ok {
+					// the JSON formatter only stringifies top-level errors
+					v = err.Error()
+				}
+				nested[k] = v
+			}
+			entry.Data = logrus.Fields{hook.nestFieldsUnder: nested}
+		}
+	}
+}
+
+const goroutineIDField = "goroutine_id"
+
+// goroutineID parses the current goroutine's id from the header of its stack trace, "goroutine 18 [running]:".
+// Go deliberately doesn't expose it, so this is slow and only meant for debugging.
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i >= 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
@@ -0,0 +1,145 @@
+package insightops_logrus
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnrichmentPipelineOrder(t *testing.T) {
+	s := newLineServer(t, nil)
+	options := func(pipeline []Stage) *Opts {
+		return &Opts{
+			Priority:           logrus.DebugLevel,
+			ByteSliceEncoding:  ByteSliceString,
+			CollapseNewlines:   " | ",
+			NestFieldsUnder:    "fields",
+			EnrichmentPipeline: pipeline,
+		}
+	}
+	fields := logrus.Fields{"body": []byte("a\nb")}
+
+	// by default byte slices are rendered before newlines are collapsed
+	hook := newTestHook(t, s, options(nil))
+	newTestLogger(hook).WithFields(fields).Info("default")
+	assert.Equal(t, map[string]interface{}{"body": "a | b"}, nextPayload(t, s)["fields"])
+
+	// collapsing first leaves the newline, as it only applies to strings
+	hook = newTestHook(t, s, options([]Stage{StageCollapseNewlines, StageByteSlices, StageNest}))
+	newTestLogger(hook).WithFields(fields).Info("reordered")
+	assert.Equal(t, map[string]interface{}{"body": "a\nb"}, nextPayload(t, s)["fields"])
+
+	// leaving a stage out disables it
+	hook = newTestHook(t, s, options([]Stage{StageByteSlices, StageCollapseNewlines}))
+	newTestLogger(hook).WithFields(fields).Info("no nesting")
+	payload := nextPayload(t, s)
+	assert.Equal(t, "a | b", payload["body"])
+	assert.NotContains(t, payload, "fields")
+}
+
+func TestAddGoroutineID(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, AddGoroutineID: true})
+	logger := newTestLogger(hook)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger.Info("from a goroutine")
+	}()
+	<-done
+	logger.Info("from the test")
+
+	first, second := nextPayload(t, s), nextPayload(t, s)
+	assert.Greater(t, first[goroutineIDField], float64(0))
+	assert.Greater(t, second[goroutineIDField], float64(0))
+	assert.NotEqual(t, first[goroutineIDField], second[goroutineIDField])
+	assert.Equal(t, float64(goroutineID()), second[goroutineIDField])
+}
+
+func TestErrorClassifier(t *testing.T) {
+	s := newLineServer(t, nil)
+	digits := regexp.MustCompile(`[0-9]+`)
+	hook := newTestHook(t, s, &Opts{
+		Priority:        logrus.DebugLevel,
+		ErrorClassField: "alert_group",
+		ErrorClassifier: func(entry *logrus.Entry) string {
+			return digits.ReplaceAllString(entry.Message, "N")
+		},
+	})
+	logger := newTestLogger(hook)
+
+	logger.Error("order 1234 failed after 3 attempts")
+	assert.Equal(t, "order N failed after N attempts", nextPayload(t, s)["alert_group"])
+
+	// entries below Error level are not classified
+	logger.Warn("order 1234 is slow")
+	assert.NotContains(t, nextPayload(t, s), "alert_group")
+}
+
+func TestRedaction(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{
+		Priority:     logrus.DebugLevel,
+		RedactFields: []string{"password", "Authorization"},
+		RedactFunc: func(key string, val interface{}) (interface{}, bool) {
+			if card, ok := val.(string); ok && key == "card" && len(card) > 4 {
+				return strings.Repeat("*", len(card)-4) + card[len(card)-4:], true
+			}
+			return nil, false
+		},
+		// redaction can't be left out of a custom pipeline
+		EnrichmentPipeline: []Stage{StageNest},
+		NestFieldsUnder:    "fields",
+	})
+
+	fields := logrus.Fields{
+		"PASSWORD":      "hunter2",
+		"authorization": "Bearer abc",
+		"card":          "4111111111111111",
+		"user":          "alice",
+	}
+	entry := &logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "login", Data: fields}
+	require.NoError(t, hook.Fire(entry))
+
+	assert.Equal(t, map[string]interface{}{
+		"PASSWORD":      "[REDACTED]",
+		"authorization": "[REDACTED]",
+		"card":          "************1111",
+		"user":          "alice",
+	}, nextPayload(t, s)["fields"])
+	assert.Equal(t, "hunter2", entry.Data["PASSWORD"], "the source entry is untouched")
+	assert.Equal(t, "4111111111111111", entry.Data["card"])
+}
+
+func TestTransformEntry(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{
+		Priority: logrus.DebugLevel,
+		TransformEntry: func(entry *logrus.Entry) *logrus.Entry {
+			if entry.Data["drop"] == true {
+				return nil
+			}
+			entry.Data["transformed"] = true
+			entry.Message = strings.ToUpper(entry.Message)
+			return entry
+		},
+	})
+
+	entry := &logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "kept", Data: logrus.Fields{}}
+	require.NoError(t, hook.Fire(entry))
+	payload := nextPayload(t, s)
+	assert.Equal(t, true, payload["transformed"])
+	assert.Equal(t, "KEPT", payload["msg"])
+	assert.NotContains(t, entry.Data, "transformed", "the source entry is untouched")
+	assert.Equal(t, "kept", entry.Message)
+
+	require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "dropped", Data: logrus.Fields{"drop": true}}))
+	require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "after"}))
+	assert.Equal(t, "AFTER", nextPayload(t, s)["msg"])
+	assert.Equal(t, uint64(1), hook.Stats().DroppedTransform)
+}
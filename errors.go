@@ -0,0 +1,37 @@
+package insightops_logrus
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors wrapped by the ConfigError the constructors return, for use with errors.Is
+var (
+	ErrTokenRequired       = errors.New("insightops: a token is required")
+	ErrInvalidToken        = errors.New("insightops: the token is not a UUID")
+	ErrInvalidRegion       = errors.New("insightops: unknown region")
+	ErrDatahubHostRequired = errors.New("insightops: a datahub host is required")
+	ErrConnRequired        = errors.New("insightops: a connection is required")
+	ErrInvalidOption       = errors.New("insightops: invalid option")
+)
+
+// ConfigError is returned by New, NewFromEnv and NewWithConn when their arguments or options are invalid
+type ConfigError struct {
+	Field string // the argument or Opts field at fault, e.g. "Token" or "DatahubConfig.Host"
+	Err   error  // one of the sentinel errors above
+
+	message string
+}
+
+func (e *ConfigError) Error() string {
+	return "unable to create new hook: " + e.message
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// configError returns a ConfigError for field wrapping sentinel, with a message formatted as fmt.Sprintf does
+func configError(field string, sentinel error, format string, args ...interface{}) error {
+	return &ConfigError{Field: field, Err: sentinel, message: fmt.Sprintf(format, args...)}
+}
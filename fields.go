@@ -0,0 +1,193 @@
+package insightops_logrus
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"strings"
+)
+
+// EmptyKind is a set of value kinds treated as empty by Opts.OmitEmpty
+type EmptyKind int
+
+const (
+	EmptyNil        EmptyKind = 1 << iota // nil, including nil pointers, interfaces, maps and slices
+	EmptyString                           // ""
+	EmptyZero                             // numeric zero and false
+	EmptyCollection                       // non-nil slices, maps and arrays with no elements
+)
+
+// matches reports whether v is empty for any of the kinds in k
+func (k EmptyKind) matches(v interface{}) bool {
+	if v == nil {
+		return k&EmptyNil != 0
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Func, reflect.Chan:
+		return k&EmptyNil != 0 && rv.IsNil()
+	case reflect.Map, reflect.Slice:
+		if rv.IsNil() {
+			return k&EmptyNil != 0
+		}
+		return k&EmptyCollection != 0 && rv.Len() == 0
+	case reflect.Array:
+		return k&EmptyCollection != 0 && rv.Len() == 0
+	case reflect.String:
+		return k&EmptyString != 0 && rv.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return k&EmptyZero != 0 && rv.IsZero()
+	}
+	return false
+}
+
+// ByteSliceEncoding selects how []byte field values are rendered
+type ByteSliceEncoding int
+
+const (
+	ByteSliceBase64  ByteSliceEncoding = iota // base64, as encoding/json renders []byte
+	ByteSliceHex                              // lowercase hex
+	ByteSliceString                           // the bytes as a string
+	ByteSlicePreview                          // the first Opts.ByteSlicePreviewBytes as a string, followed by the total length
+)
+
+const defaultBytePreviewLen = 64
+
+// encode renders b according to e
+func (e ByteSliceEncoding) encode(b []byte, previewLen int) interface{} {
+	switch e {
+	case ByteSliceHex:
+		return hex.EncodeToString(b)
+	case ByteSliceString:
+		return string(b)
+	case ByteSlicePreview:
+		if len(b) <= previewLen {
+			return string(b)
+		}
+		return fmt.Sprintf("%s... (%d bytes)", b[:previewLen], len(b))
+	}
+	return b
+}
+
+// collapseNewlines replaces each line break in s (\r\n, \n or \r) with token
+func collapseNewlines(s string, token string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.ReplaceAll(s, "\n", token)
+}
+
+// truncateLines keeps the first max lines of s, noting how many were cut
+func truncateLines(s string, max int) string {
+	lines := strings.SplitAfterN(s, "\n", max+1)
+	if len(lines) <= max {
+		return s
+	}
+	rest := strings.Count(lines[max], "\n") + 1
+	if strings.HasSuffix(lines[max], "\n") {
+		rest--
+	}
+	return strings.Join(lines[:max], "") + fmt.Sprintf("... (%d more lines truncated)", rest)
+}
+
+const redacted = "[REDACTED]"
+
+// redact masks the values of Opts.RedactFields, and whatever Opts.RedactFunc masks, in entry, which must be a copy
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) redact(entry *logrus.Entry) {
+	if hook.redactFields == nil && hook.redactFunc == nil {
+		return
+	}
+	for k, v := range entry.Data {
+		if _, ok := hook.redactFields[strings.ToLower(k)]; ok {
+			entry.Data[k] = redacted
+		} else if hook.redactFunc != nil {
+			if masked, ok := hook.redactFunc(k, v); ok {
+				entry.Data[k] = masked
+			}
+		}
+	}
+}
+
+// namedField is a field name set by an option, for conflict checks
+type namedField struct {
+	option string
+	name   string
+}
+
+// reservedFields are written by the formatter itself
+var reservedFields = []string{logrus.FieldKeyMsg, logrus.FieldKeyLevel, logrus.FieldKeyTime}
+
+// fieldNames holds the field names configured through Opts, with defaults filled in
+type fieldNames struct {
+	eventID    string
+	region     string
+	errorClass string
+}
+
+// resolveFieldNames fills in the defaults of the field names options leaves empty, leaving options itself untouched as
+// it may be shared between hooks
+func resolveFieldNames(options *Opts) fieldNames {
+	names := fieldNames{eventID: options.EventIDField, region: options.RegionField, errorClass: options.ErrorClassField}
+	if options.AddEventID && names.eventID == "" {
+		names.eventID = defaultEventIDField
+	}
+	if options.AddRegionField && names.region == "" {
+		names.region = defaultRegionField
+	}
+	if options.ErrorClassifier != nil && names.errorClass == "" {
+		names.errorClass = defaultErrorClass
+	}
+	return names
+}
+
+// validateFieldNames checks the field names configured through options, resolved to names, don't clash with each other
+// or with the fields the formatter writes, which would otherwise leave one of them silently overwritten
+func validateFieldNames(options *Opts, names fieldNames) error {
+	var fields []namedField
+	if options.AddEventID {
+		fields = append(fields, namedField{"EventIDField", names.eventID})
+	}
+	if options.AddRegionField {
+		fields = append(fields, namedField{"RegionField", names.region})
+	}
+	if options.AddGoroutineID {
+		fields = append(fields, namedField{"AddGoroutineID", goroutineIDField})
+	}
+	if options.ErrorClassifier != nil {
+		fields = append(fields, namedField{"ErrorClassField", names.errorClass})
+	}
+	if options.RequiredFieldsPolicy == MarkMissingRequired && len(options.RequiredFields) > 0 {
+		fields = append(fields, namedField{"RequiredFieldsPolicy", missingRequiredKey})
+	}
+	fields = append(fields,
+		namedField{"OriginalTimestampField", options.OriginalTimestampField},
+		namedField{"NestFieldsUnder", options.NestFieldsUnder},
+	)
+	if options.NestFieldsUnder == "" {
+		fields = append(fields, namedField{"DataKey", options.DataKey})
+	}
+
+	seen := map[string]string{}
+	for _, reserved := range reservedFields {
+		seen[reserved] = "the formatter"
+	}
+	for _, field := range fields {
+		if field.name == "" {
+			continue
+		}
+		if other, ok := seen[field.name]; ok {
+			return configError(field.option, ErrInvalidOption, "%s and %s both use the field %q", other, field.option, field.name)
+		}
+		seen[field.name] = field.option
+	}
+	return nil
+}
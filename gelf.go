@@ -0,0 +1,65 @@
+package insightops_logrus
+
+import (
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+)
+
+// GELFFormatter formats entries as GELF 1.1 JSON, for Graylog and other GELF consumers. Entry fields become
+// additional "_"-prefixed fields and levels are mapped to syslog severities.
+type GELFFormatter struct {
+	Host string // defaults to os.Hostname
+}
+
+// gelfLevels maps logrus levels to syslog severities
+var gelfLevels = map[logrus.Level]int{
+	logrus.PanicLevel: 0, // emergency
+	logrus.FatalLevel: 2, // critical
+	logrus.ErrorLevel: 3, // error
+	logrus.WarnLevel:  4, // warning
+	logrus.InfoLevel:  6, // informational
+	logrus.DebugLevel: 7, // debug
+	logrus.TraceLevel: 7, // debug
+}
+
+// Format renders a single entry as a GELF message
+func (f *GELFFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	host := f.Host
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+
+	short, full := entry.Message, ""
+	if i := strings.IndexByte(entry.Message, '\n'); i >= 0 {
+		short, full = entry.Message[:i], entry.Message
+	}
+
+	message := map[string]interface{}{
+		"version":       "1.1",
+		"host":          host,
+		"short_message": short,
+		"timestamp":     float64(entry.Time.UnixNano()) / 1e9,
+		"level":         gelfLevels[entry.Level],
+	}
+	if full != "" {
+		message["full_message"] = full
+	}
+	for k, v := range entry.Data {
+		if k == "id" {
+			// _id is reserved by GELF
+			k = "id_"
+		}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		message["_"+k] = v
+	}
+
+	serialized, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return append(serialized, '\n'), nil
+}
@@ -0,0 +1,44 @@
+package insightops_logrus
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGELFOutput(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, GELF: true})
+	logger := newTestLogger(hook)
+
+	entry := logger.WithFields(logrus.Fields{"user": "alice", "id": 7, "error": errors.New("boom")})
+	entry.Time = time.Unix(1700000000, 500000000)
+	entry.Error("request failed\nstack line 1\nstack line 2")
+
+	// the hostname is looked up once, not on every Format
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, host, hook.formatter.(*GELFFormatter).Host)
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "1.1", payload["version"])
+	assert.Equal(t, host, payload["host"])
+	assert.Equal(t, "request failed", payload["short_message"])
+	assert.Equal(t, "request failed\nstack line 1\nstack line 2", payload["full_message"])
+	assert.Equal(t, 1700000000.5, payload["timestamp"])
+	assert.Equal(t, float64(3), payload["level"])
+	assert.Equal(t, "alice", payload["_user"])
+	assert.Equal(t, float64(7), payload["_id_"])
+	assert.Equal(t, "boom", payload["_error"])
+	assert.NotContains(t, payload, "user")
+	assert.NotContains(t, payload, "msg")
+
+	logger.Warn("single line")
+	payload = nextPayload(t, s)
+	assert.Equal(t, float64(4), payload["level"])
+	assert.NotContains(t, payload, "full_message")
+}
@@ -0,0 +1,178 @@
+package insightops_logrus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Transport selects how the hook ships lines to InsightOps
+type Transport int
+
+const (
+	TransportTCP  Transport = iota // token-prefixed lines over pooled TCP (or datahub) connections
+	TransportHTTP                  // lines POSTed to the HTTP ingestion endpoint, for networks that only allow outbound HTTPS
+)
+
+// Compression selects how TransportHTTP encodes request bodies
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip             // bodies are gzipped and sent with Content-Encoding: gzip; pays off most with Opts.BatchSize
+	CompressionZstd             // bodies are encoded by Opts.ZstdEncoder and sent with Content-Encoding: zstd, for agents that accept it
+)
+
+const httpHostPostfix = ".webhook.logs.insight.rapid7.com"
+
+// validateHTTPOptions rejects the options TransportHTTP can't honour: those of the connection pool, as the client
+// keeps its own, and with Opts.HTTPClient those of the hook's dialing, which that client does instead
+func validateHTTPOptions(options *Opts) error {
+	type setOption struct {
+		option string
+		set    bool
+	}
+
+	for _, o := range []setOption{
+		{"PrewarmPool", options.PrewarmPool},
+		{"ValidateConnOnBorrow", options.ValidateConnOnBorrow},
+	} {
+		if o.set {
+			return configError(o.option, ErrInvalidOption, "%s applies to the connection pool, which TransportHTTP doesn't use", o.option)
+		}
+	}
+
+	if options.HTTPClient == nil {
+		return nil
+	}
+	for _, o := range []setOption{
+		{"TlsConfig", options.TlsConfig != nil},
+		{"MinTLSVersion", options.MinTLSVersion != 0},
+		{"PinnedCertSHA256", options.PinnedCertSHA256 != nil},
+		{"Resolver", options.Resolver != nil},
+		{"StaticHosts", options.StaticHosts != nil},
+		{"RotateAddresses", options.RotateAddresses},
+		{"ReResolveInterval", options.ReResolveInterval != 0},
+		{"ProxyProtocol", options.ProxyProtocol != ""},
+		{"Backoff", options.Backoff != nil},
+		{"IdleTimeout", options.IdleTimeout != 0},
+		{"FailOnConnectError", options.FailOnConnectError},
+		{"StartupProbeRetries", options.StartupProbeRetries != 0},
+		{"NoPooling", options.NoPooling},
+	} {
+		if o.set {
+			return configError(o.option, ErrInvalidOption, "%s can't be combined with HTTPClient, which does its own dialing", o.option)
+		}
+	}
+	return nil
+}
+
+// httpIngestURL returns the HTTP ingestion endpoint for token, which goes in the path rather than in each line. It
+// names the configured host even when StaticHosts pins an IP, which only the client's dialing substitutes, so the
+// Host header and TLS verification still see the ingestion host.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) httpIngestURL(token string) string {
+	host := net.JoinHostPort(hook.host, strconv.Itoa(hook.port))
+	return (&url.URL{Scheme: "https", Host: host, Path: "/v1/noformat/" + token}).String()
+}
+
+// newHTTPClient returns the client used by TransportHTTP when Opts.HTTPClient isn't set. Its connections are dialed
+// by connect, TLS included, so they get the same StaticHosts, RotateAddresses, ProxyProtocol, Backoff, pinning and
+// SetMaxTotalConnections treatment as the TCP transport's. Its idle connections are kept up to PoolSize and for
+// IdleTimeout, if set, or not at all with NoPooling. It doesn't go through an HTTP proxy.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialTLSContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		deadline, _ := ctx.Deadline()
+		conn, err := hook.connect(ctx, deadline)
+		if err != nil {
+			return nil, err
+		}
+		// connect leaves the deadline set for a first write, but the client reuses the connection for later requests
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+	transport.MaxIdleConnsPerHost = hook.poolSize
+	transport.DisableKeepAlives = hook.noPooling
+	if hook.idleTimeout > 0 {
+		transport.IdleConnTimeout = hook.idleTimeout
+	}
+	return &http.Client{Transport: transport}
+}
+
+// post sends data, one or more newline-terminated lines, in a single request bounded by Opts.WriteTimeout and by
+// deadline (if not zero)
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) post(ctx context.Context, data []byte, deadline time.Time) error {
+	if deadline = hook.writeDeadline(deadline); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	// small requests are sent as they are, see Opts.CompressMinBatchBytes
+	var encoding string
+	if hook.compression != CompressionNone && len(data) >= hook.compressMin {
+		var err error
+		if data, encoding, err = hook.compress(data); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.httpURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	resp, err := hook.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	// reading the body to the end lets the client reuse the connection
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("insightops: HTTP ingestion responded %s", resp.Status)
+	}
+	return nil
+}
+
+// compress encodes data with the configured Compression, returning it with its Content-Encoding
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) compress(data []byte) ([]byte, string, error) {
+	if hook.compression == CompressionZstd {
+		encoded, err := hook.zstdEncoder(data)
+		return encoded, "zstd", err
+	}
+	encoded, err := gzipData(data)
+	return encoded, "gzip", err
+}
+
+// gzipData returns data gzipped
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,401 @@
+package insightops_logrus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newHTTPTestHook creates a hook posting to server
+func newHTTPTestHook(t *testing.T, server *httptest.Server, options *Opts) *InsightOpsHook {
+	t.Helper()
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	options.Transport = TransportHTTP
+	options.EndpointHost = u.Hostname()
+	options.EndpointPort = port
+	options.HTTPClient = server.Client()
+	hook, err := New("00000000-0000-0000-0000-000000000000", "eu", options)
+	require.NoError(t, err)
+	t.Cleanup(hook.FlushAndClose)
+	return hook
+}
+
+func TestHTTPTransport(t *testing.T) {
+	var mu sync.Mutex
+	var paths, bodies []string
+	status := http.StatusNoContent
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	hook := newHTTPTestHook(t, server, &Opts{Priority: logrus.DebugLevel})
+	logger := newTestLogger(hook)
+	logger.Info("one")
+	logger.Info("two")
+
+	mu.Lock()
+	assert.Equal(t, []string{
+		"POST /v1/noformat/00000000-0000-0000-0000-000000000000",
+		"POST /v1/noformat/00000000-0000-0000-0000-000000000000",
+	}, paths)
+	require.Len(t, bodies, 2)
+	// the token is in the path, so the lines go as they are
+	assert.True(t, strings.HasPrefix(bodies[0], `{"level":"info","msg":"one"`), bodies[0])
+	assert.True(t, strings.HasPrefix(bodies[1], `{"level":"info","msg":"two"`), bodies[1])
+	assert.True(t, strings.HasSuffix(bodies[0], "}\n"), bodies[0])
+	paths, bodies = nil, nil
+	status = http.StatusForbidden
+	mu.Unlock()
+
+	// a rejected request fails the Fire
+	err := hook.Fire(&logrus.Entry{Level: logrus.InfoLevel, Message: "refused"})
+	assert.ErrorContains(t, err, "403")
+	assert.Equal(t, uint64(2), hook.Stats().Sent)
+	assert.Equal(t, uint64(1), hook.Stats().Failed)
+}
+
+func TestHTTPTransportBatches(t *testing.T) {
+	bodies := make(chan string, 10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	hook := newHTTPTestHook(t, server, &Opts{Priority: logrus.DebugLevel, BatchSize: 3})
+	logger := newTestLogger(hook)
+	for i := 0; i < 3; i++ {
+		logger.WithField("n", i).Info("batched")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(<-bodies, "\n"), "\n")
+	require.Len(t, lines, 3)
+	for i, line := range lines {
+		assert.Contains(t, line, `"n":`+strconv.Itoa(i))
+	}
+	assert.Empty(t, bodies, "the batch went in a single request")
+}
+
+func TestHTTPTransportFallbackKeepsToken(t *testing.T) {
+	for _, batchSize := range []int{0, 2} {
+		t.Run(strconv.Itoa(batchSize), func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			var fallback bytes.Buffer
+			hook := newHTTPTestHook(t, server, &Opts{Priority: logrus.DebugLevel, BatchSize: batchSize, Fallback: &fallback, OnError: func(error) {}})
+			for i := 0; i < 2; i++ {
+				require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: strconv.Itoa(i)}))
+			}
+
+			// the lines can be replayed over TCP, which needs the token the HTTP requests carried in the URL
+			lines := strings.SplitAfter(strings.TrimSuffix(fallback.String(), "\n"), "\n")
+			require.Len(t, lines, 2)
+			for i, line := range lines {
+				assert.True(t, strings.HasPrefix(line, "00000000-0000-0000-0000-000000000000{"), line)
+				assert.Contains(t, line, `"msg":"`+strconv.Itoa(i)+`"`)
+			}
+			assert.Equal(t, uint64(2), hook.Stats().FellBack)
+		})
+	}
+}
+
+func TestHTTPTransportGzip(t *testing.T) {
+	type request struct {
+		encoding string
+		size     int
+		body     string
+	}
+	requests := make(chan request, 10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := io.ReadAll(r.Body)
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		requests <- request{r.Header.Get("Content-Encoding"), len(compressed), string(body)}
+	}))
+	defer server.Close()
+
+	hook := newHTTPTestHook(t, server, &Opts{Priority: logrus.DebugLevel, BatchSize: 10, Compression: CompressionGzip})
+	logger := newTestLogger(hook)
+	for i := 0; i < 10; i++ {
+		logger.WithField("n", i).WithField("detail", strings.Repeat("verbose ", 20)).Info("compressible")
+	}
+
+	req := <-requests
+	assert.Equal(t, "gzip", req.encoding)
+	assert.Less(t, req.size, len(req.body)/4)
+	lines := strings.Split(strings.TrimSuffix(req.body, "\n"), "\n")
+	require.Len(t, lines, 10)
+	for i, line := range lines {
+		var payload map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &payload))
+		assert.Equal(t, float64(i), payload["n"])
+		assert.Equal(t, "compressible", payload["msg"])
+	}
+
+	// the TCP transport takes plain lines only
+	_, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{Compression: CompressionGzip})
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
+
+// mockZstd stands in for a zstd codec, which this module doesn't depend on: encoding reverses data behind a magic
+// prefix, and decoding checks the prefix and undoes the reversal
+var mockZstd = struct {
+	encode func([]byte) ([]byte, error)
+	decode func([]byte) ([]byte, error)
+}{
+	encode: func(data []byte) ([]byte, error) {
+		encoded := []byte("zstd-mock:")
+		for i := len(data) - 1; i >= 0; i-- {
+			encoded = append(encoded, data[i])
+		}
+		return encoded, nil
+	},
+	decode: func(encoded []byte) ([]byte, error) {
+		reversed, ok := bytes.CutPrefix(encoded, []byte("zstd-mock:"))
+		if !ok {
+			return nil, errors.New("not zstd-mock encoded")
+		}
+		data := make([]byte, 0, len(reversed))
+		for i := len(reversed) - 1; i >= 0; i-- {
+			data = append(data, reversed[i])
+		}
+		return data, nil
+	},
+}
+
+func TestHTTPTransportZstd(t *testing.T) {
+	type request struct {
+		encoding string
+		body     string
+	}
+	requests := make(chan request, 10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoded, _ := io.ReadAll(r.Body)
+		body, err := mockZstd.decode(encoded)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- request{r.Header.Get("Content-Encoding"), string(body)}
+	}))
+	defer server.Close()
+
+	hook := newHTTPTestHook(t, server, &Opts{
+		Priority:    logrus.DebugLevel,
+		BatchSize:   3,
+		Compression: CompressionZstd,
+		ZstdEncoder: mockZstd.encode,
+	})
+	logger := newTestLogger(hook)
+	for i := 0; i < 3; i++ {
+		logger.WithField("n", i).Info("batched")
+	}
+
+	req := <-requests
+	assert.Equal(t, "zstd", req.encoding)
+	lines := strings.Split(strings.TrimSuffix(req.body, "\n"), "\n")
+	require.Len(t, lines, 3)
+	for i, line := range lines {
+		assert.Contains(t, line, `"n":`+strconv.Itoa(i))
+	}
+
+	// the encoder is the caller's to supply
+	_, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{Transport: TransportHTTP, Compression: CompressionZstd})
+	assert.ErrorIs(t, err, ErrInvalidOption)
+	assert.ErrorContains(t, err, "ZstdEncoder")
+}
+
+func TestHTTPTransportCompressMinBatchBytes(t *testing.T) {
+	type request struct {
+		encoding string
+		body     string
+	}
+	requests := make(chan request, 10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		b, _ := io.ReadAll(body)
+		requests <- request{r.Header.Get("Content-Encoding"), string(b)}
+	}))
+	defer server.Close()
+
+	hook := newHTTPTestHook(t, server, &Opts{
+		Priority:              logrus.DebugLevel,
+		BatchSize:             5,
+		Compression:           CompressionGzip,
+		CompressMinBatchBytes: 1024,
+	})
+	logger := newTestLogger(hook)
+
+	// a small batch goes out plain
+	logger.Info("small")
+	_, _ = hook.flushBatch(context.Background(), time.Time{}, flushedByInterval)
+	req := <-requests
+	assert.Empty(t, req.encoding)
+	assert.Contains(t, req.body, `"msg":"small"`)
+
+	// a full batch of longer lines is compressed
+	for i := 0; i < 5; i++ {
+		logger.WithField("detail", strings.Repeat("verbose ", 40)).Info("large")
+	}
+	req = <-requests
+	assert.Equal(t, "gzip", req.encoding)
+	assert.Equal(t, 5, strings.Count(req.body, `"msg":"large"`))
+}
+
+func TestHTTPTransportStaticHosts(t *testing.T) {
+	const host = "ingest.example"
+	cert, roots := newTestCertificate(t, host)
+	hosts := make(chan string, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+
+	hook, err := New("00000000-0000-0000-0000-000000000000", "", &Opts{
+		Priority:           logrus.DebugLevel,
+		Transport:          TransportHTTP,
+		EndpointHost:       host,
+		EndpointPort:       port,
+		StaticHosts:        map[string]string{host: "127.0.0.1"},
+		TlsConfig:          &tls.Config{RootCAs: roots},
+		FailOnConnectError: true,
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+
+	// the pinned IP is only dialed; the request still names, and TLS still verifies, the ingestion host
+	require.NoError(t, hook.Fire(&logrus.Entry{Level: logrus.InfoLevel, Message: "pinned"}))
+	assert.Equal(t, net.JoinHostPort(host, strconv.Itoa(port)), <-hosts)
+}
+
+// countingDialer dials address in plain tcp, counting dials and closes
+type countingDialer struct {
+	address string
+	dials   atomic.Int32
+	closes  atomic.Int32
+}
+
+func (d *countingDialer) dial(ctx context.Context, deadline time.Time) (net.Conn, error) {
+	d.dials.Add(1)
+	conn, err := (&net.Dialer{Deadline: deadline}).DialContext(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+	return &closeCountingConn{Conn: conn, closes: &d.closes}, nil
+}
+
+type closeCountingConn struct {
+	net.Conn
+	closes *atomic.Int32
+	once   sync.Once
+}
+
+func (c *closeCountingConn) Close() error {
+	c.once.Do(func() { c.closes.Add(1) })
+	return c.Conn.Close()
+}
+
+func TestHTTPTransportDialsThroughHook(t *testing.T) {
+	requests := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- string(body)
+	}))
+	defer server.Close()
+
+	// New's test connection, made before the dialer is swapped, fails its TLS handshake with the plain server
+	hook, err := New("00000000-0000-0000-0000-000000000000", "", &Opts{
+		Priority:     logrus.DebugLevel,
+		Transport:    TransportHTTP,
+		EndpointHost: "127.0.0.1",
+		EndpointPort: server.Listener.Addr().(*net.TCPAddr).Port,
+		OnError:      func(error) {},
+	})
+	require.NoError(t, err)
+	// a plain tcp dialer in place of the hook's own, so the client talks plain HTTP to the test server
+	dialer := &countingDialer{address: server.Listener.Addr().String()}
+	hook.connDialer = dialer
+
+	logger := newTestLogger(hook)
+	logger.Info("one")
+	logger.Info("two")
+	assert.Contains(t, <-requests, `"msg":"one"`)
+	assert.Contains(t, <-requests, `"msg":"two"`)
+	assert.Equal(t, int32(1), dialer.dials.Load(), "the connection is reused")
+
+	// closing the hook closes the client's idle connections
+	hook.FlushAndClose()
+	assert.Equal(t, int32(1), dialer.closes.Load())
+}
+
+func TestHTTPTransportRejectsUnsupportedOptions(t *testing.T) {
+	for _, c := range []struct {
+		field   string
+		options Opts
+	}{
+		{"PrewarmPool", Opts{PrewarmPool: true}},
+		{"ValidateConnOnBorrow", Opts{ValidateConnOnBorrow: true}},
+		{"StaticHosts", Opts{HTTPClient: http.DefaultClient, StaticHosts: map[string]string{"a": "127.0.0.1"}}},
+		{"ProxyProtocol", Opts{HTTPClient: http.DefaultClient, ProxyProtocol: "v1"}},
+		{"Backoff", Opts{HTTPClient: http.DefaultClient, Backoff: &Backoff{}}},
+		{"IdleTimeout", Opts{HTTPClient: http.DefaultClient, IdleTimeout: time.Minute}},
+		{"NoPooling", Opts{HTTPClient: http.DefaultClient, NoPooling: true}},
+		{"ReResolveInterval", Opts{HTTPClient: http.DefaultClient, ReResolveInterval: time.Minute}},
+	} {
+		t.Run(c.field, func(t *testing.T) {
+			options := c.options
+			options.Transport = TransportHTTP
+			_, err := New("00000000-0000-0000-0000-000000000000", "eu", &options)
+			assert.ErrorIs(t, err, ErrInvalidOption)
+			var configErr *ConfigError
+			require.ErrorAs(t, err, &configErr)
+			assert.Equal(t, c.field, configErr.Field)
+		})
+	}
+}
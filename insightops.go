@@ -1,76 +1,388 @@
 package insightops_logrus
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // InsightOpsHook used to send logs to insightOps (rapid7) formally logentries
 type InsightOpsHook struct {
-	encrypt   bool
-	token     string
-	levels    []logrus.Level
-	formatter *logrus.JSONFormatter
-	network   string
-	port      int
-	tlsConfig *tls.Config
-	host      string
+	encrypt        bool
+	token          string // inlined ahead of each line; empty over TransportHTTP, which sends it in httpURL
+	levels         []logrus.Level
+	levelsMutex    sync.RWMutex
+	formatter      logrus.Formatter
+	formatterMutex sync.RWMutex
+	network        string
+	port           int
+	tlsConfig      *tls.Config
+	minTLSVersion  uint16
+	pinnedCerts    [][32]byte
+	host           string
+	region         string
+
+	// conn is set by NewWithConn; the hook then writes to it instead of dialing
+	conn      net.Conn
+	connMutex sync.Mutex
+
+	// pool holds idle connections for reuse between writes
+	pool                 chan idleConn
+	poolSize             int
+	poolMutex            sync.Mutex
+	validateConnOnBorrow bool
+	noPooling            bool
+	prewarmConcurrency   int
+	idleTimeout          time.Duration
+	reaperStop           chan struct{} // closed by FlushAndClose to stop the idle reaper
+	resolverStop         chan struct{} // closed by FlushAndClose to stop the ReResolveInterval checks
+	poolGeneration       atomic.Uint64 // bumped, under poolMutex, when the pool is recycled after the host's addresses change
+	closed               bool          // set by FlushAndClose, under poolMutex
+
+	// queue holds formatted lines for the background writer in async mode
+	queue       chan queuedLine
+	queuePolicy QueueFullPolicy
+	queueMutex  sync.RWMutex // held for reading while enqueueing, and for writing to close the queue
+	queueClosed bool
+	queueDone   chan struct{}
+	// queueClosing is closed when shutdown starts, releasing Fires blocked waiting for room so it can close the queue
+	queueClosing     chan struct{}
+	queueClosingOnce sync.Once
+	// batch holds formatted lines waiting to be written together, see Opts.BatchSize
+	batchSize     int
+	batchInterval time.Duration
+	batchWritev   bool
+	batchMutex    sync.Mutex // guards the batch contents and timer
+	batch         []queuedLine
+	batchClosed   bool
+	batchTimer    *time.Timer
+	flushMutex    sync.Mutex // held while a batch is written, so batches go out in order
+
+	// memPressureStop is closed by FlushAndClose to stop the FlushOnMemPressure checks
+	memPressureStop chan struct{}
+
+	// queueCtx bounds the background writer's writes; abandonQueue cancels it when shutdown runs out of time
+	queueCtx     context.Context
+	abandonQueue context.CancelFunc
+
+	dialer        *net.Dialer  // template for each dial, which sets its own Deadline
+	connDialer    connDialer   // replaces dial when set
+	destination   string       // the key New registered the hook under, unregistered by FlushAndClose
+	httpClient    *http.Client // set for TransportHTTP, which posts to httpURL instead of writing to connections
+	httpURL       string
+	compression   Compression
+	compressMin   int
+	zstdEncoder   func([]byte) ([]byte, error)
+	staticHosts   map[string]string
+	lookupHost    func(ctx context.Context, host string) ([]string, error) // resolves all addresses for RotateAddresses
+	resolveHost   func(ctx context.Context, host string) ([]string, error) // resolves all addresses for ReResolveInterval
+	nextAddress   atomic.Uint64                                            // round-robin position for RotateAddresses
+	proxyProtocol string
+	backoff       *backoff
+
+	cloudEvents       bool
+	cloudEventsSource string
+	cloudEventsType   string
+
+	tags                   logrus.Fields
+	timestampLocation      *time.Location
+	originalTimestampField string
+
+	nestFieldsUnder string
+	omitEmpty       EmptyKind
+	byteSlices      ByteSliceEncoding
+	bytePreviewLen  int
+	newlineToken    string
+	maxMessageLines int
+	pipeline        []Stage
+	validateJSON    bool
+	sendInvalidJSON bool
+	eventIDField    string
+	addGoroutineID  bool
+	errorClassifier func(*logrus.Entry) string
+	redactFields    map[string]struct{} // lower-cased
+	redactFunc      func(key string, val interface{}) (interface{}, bool)
+	transformEntry  func(*logrus.Entry) *logrus.Entry
+	errorClassField string
+	fireDeadline    time.Duration
+	writeTimeout    time.Duration
+	timeoutPolicy   WriteTimeoutPolicy
+	fireSlots       chan struct{}
+	fireSlotWait    time.Duration
+	rateLimiter     *rateLimiter
+	rateLimitPolicy RateLimitPolicy
+	onDelivered     func(count int, bytes int)
+	onError         func(error)
+	fallback        io.Writer
+	fallbackMutex   sync.Mutex // serialises writes to fallback, which needn't be safe for concurrent use
+	fallbackToken   string     // the token fallback lines are prefixed with, kept when TransportHTTP leaves it out of the lines sent
+
+	requiredFields       []string
+	requiredFieldsPolicy RequiredFieldsPolicy
+
+	counters counters
 }
 
 // Opts is a set of optional parameters for NewEncryptedHook
 type Opts struct {
-	Priority      logrus.Level                 // defaults to logrus.DebugLevel (include all), logging level is inclusive
-	TlsConfig     *tls.Config                  // defaults to use system's cert store; only needed if you need to use your own root certs
-	DatahubConfig *UnencryptedConnectionConfig // useful if you're using an agent to proxy requests (hub)
+	Priority         logrus.Level                 // defaults to logrus.DebugLevel (include all), logging level is inclusive
+	TlsConfig        *tls.Config                  // defaults to use system's cert store; only needed if you need to use your own root certs
+	MinTLSVersion    uint16                       // defaults to tls.VersionTLS12; raises TlsConfig's MinVersion when that is lower
+	PinnedCertSHA256 [][32]byte                   // when set, dials fail unless the server's leaf certificate has one of these SHA-256 fingerprints
+	Transport        Transport                    // defaults to TransportTCP; TransportHTTP posts lines over HTTPS instead, where raw TCP is blocked
+	HTTPClient       *http.Client                 // used by TransportHTTP; defaults to a client dialing through the hook like the TCP transport. A client of your own does its own dialing, so the hook's dial options are rejected with it and SetMaxTotalConnections doesn't cover it
+	Compression      Compression                  // defaults to CompressionNone; only TransportHTTP supports compression, the TCP ingestion endpoints take plain lines
+	EndpointHost     string                       // overrides the region's host, still over TLS, e.g. for a staging endpoint or private deployment; the region may then be empty
+	EndpointPort     int                          // overrides the TLS port of 443
+	DatahubConfig    *UnencryptedConnectionConfig // useful if you're using an agent to proxy requests (hub)
+	SendToken        bool                         // with DatahubConfig, requires a token; otherwise New accepts an empty token for agents that add it themselves
+	Resolver         *net.Resolver                // defaults to the system resolver; used to look up the target host when dialing
+	StaticHosts      map[string]string            // optional host to IP pinning; the pinned IP is dialed while TLS still verifies the original host
+	RotateAddresses  bool                         // resolves every address of the host and has each new connection dial the next one (round-robin), spreading connections across backends
+
+	ZstdEncoder           func([]byte) ([]byte, error) // required with CompressionZstd, e.g. wrapping a zstd.Encoder's EncodeAll; supplying it keeps a zstd dependency out of this module for everyone else
+	CompressMinBatchBytes int                          // with Compression, requests (a batch, or a single entry) smaller than this are sent uncompressed and without Content-Encoding, as compressing them costs more than it saves; defaults to compressing every request
+
+	SkipTokenValidation  bool          // accepts tokens that aren't UUIDs, for datahubs that expect their own format
+	FailOnConnectError   bool          // makes New return the error when its test connection fails, instead of returning a hook that can't deliver yet
+	ProxyProtocol        string        // "v1" or "v2" sends a PROXY protocol header on each new tcp connection; defaults to none
+	Backoff              *Backoff      // spaces out dials after failures instead of dialing on every Fire; defaults to no backoff
+	PoolSize             int           // idle connections kept for reuse; defaults to 3, at most 256
+	NoPooling            bool          // dials a connection for each write and closes it afterwards, keeping none for reuse
+	ValidateConnOnBorrow bool          // checks a pooled connection is still open before reusing it, dialing afresh instead of relying on a failed write to reconnect
+	ReResolveInterval    time.Duration // looks the host up again this often, closing pooled connections when its addresses change so failover is picked up; defaults to never
+	IdleTimeout          time.Duration // closes pooled connections left unused this long, from a background goroutine and on borrow; defaults to keeping them
+	StartupProbeRetries  int           // retries New's test connection, for dependencies still starting up such as a sidecar agent
+	StartupProbeBackoff  time.Duration // defaults to 100ms; the wait before the first startup probe retry, doubling after each
+	PrewarmPool          bool          // dials a full pool in New instead of a single test connection; if any dial fails none are kept
+	PrewarmConcurrency   int           // defaults to 1; how many of PrewarmPool's connections are dialed at once, trading startup time against a burst of dials
+	EmitStartupMarker    bool          // writes a "logger_started" entry with hostname, region and version from New, once its test connection succeeds
+
+	CloudEvents       bool   // wraps each entry in a CloudEvents 1.0 JSON envelope, with the log JSON as data
+	CloudEventsSource string // defaults to "insightops-logrus"; the CloudEvents source attribute
+	CloudEventsType   string // defaults to "com.rapid7.insightops.log"; the CloudEvents type attribute
+
+	AutoTags          []TagSource    // runtime metadata detected once in New and attached as fields to every entry, e.g. KubernetesTags
+	AddBootID         bool           // attaches the host boot id (where available) and the process start time, to correlate restarts
+	TimestampLocation *time.Location // defaults to time.UTC; entry timestamps are converted to this location before formatting
+
+	OriginalTimestampField string // when set, the entry time before conversion is kept under this field in RFC3339Nano
+
+	RequiredFields       []string             // fields every entry must carry, e.g. service and env
+	RequiredFieldsPolicy RequiredFieldsPolicy // defaults to DropMissingRequired; what happens to entries missing a required field
+
+	NestFieldsUnder string      // when set, all entry fields are nested under this key, leaving level/msg/time top-level; takes precedence over DataKey
+	DataKey         string      // passed to the JSON formatter to nest all fields under this key; ignored when NestFieldsUnder is set
+	OnError         func(error) // defaults to printing to stderr; receives delivery errors and panics recovered inside the hook
+	Fallback        io.Writer   // receives the token-prefixed lines whose write failed, e.g. a file to replay after an outage; Fire then returns nil. Failures are still reported to OnError. TransportHTTP's lines carry the token too, though it sends it in the URL
+
+	OmitEmpty      bool      // strips empty fields from the shipped entry, see OmitEmptyKinds; with EmptyNil this drops the error field WithError(nil) adds
+	OmitEmptyKinds EmptyKind // defaults to EmptyNil | EmptyString; which values count as empty when OmitEmpty is set
+
+	ValidateJSON    bool // checks each formatted line is valid JSON, reporting invalid ones to OnError and dropping them
+	SendInvalidJSON bool // ships lines that fail ValidateJSON anyway, after reporting them
+
+	AddEventID   bool   // attaches a unique id to every entry so duplicates from retried writes can be removed server-side
+	EventIDField string // defaults to "event_id"; the field AddEventID uses
+
+	AddGoroutineID bool // attaches the firing goroutine's id as "goroutine_id"; computed per entry from the stack, so for debugging only
+
+	OnBatchDelivered func(count int, bytes int) // called after entries are written without error, with the entry count and bytes written (token included)
+
+	ByteSliceEncoding     ByteSliceEncoding // defaults to ByteSliceBase64 (the JSON default); how []byte field values are rendered
+	ByteSlicePreviewBytes int               // defaults to 64; how many bytes ByteSlicePreview keeps
+
+	CollapseNewlines string // when set, newlines inside string (and error) field values are replaced with this, e.g. " | "
+	MaxMessageLines  int    // when set, messages are cut to their first lines, e.g. to bound stack dumps, noting how many were dropped
+
+	FireDeadline       time.Duration      // bounds the dial and write done by each Fire; entries that miss it are dropped and counted
+	WriteTimeout       time.Duration      // defaults to 5s, negative disables; bounds each write so a black-holed connection can't block forever
+	WriteTimeoutPolicy WriteTimeoutPolicy // defaults to WriteTimeoutFail; what happens to a write that times out, which may have partly landed
+
+	MaxConcurrentFires int           // caps how many Fire calls proceed at once; excess entries are dropped and counted. Defaults to no cap
+	FireAdmissionWait  time.Duration // how long an excess Fire waits for a slot before being dropped; defaults to not waiting
+
+	MaxLinesPerSecond int             // caps the rate entries are shipped at, protecting the account's volume allotment; defaults to no cap
+	BurstSize         int             // defaults to MaxLinesPerSecond; how many entries may ship at once after a quiet spell
+	RateLimitPolicy   RateLimitPolicy // defaults to RateLimitDrop; what happens to entries over MaxLinesPerSecond
+
+	EnrichmentPipeline []Stage // defaults to DefaultEnrichmentPipeline; the order entry enrichment stages run in, leaving a stage out disables it
+
+	WarnOnDuplicate bool // reports through OnError when another hook already ships with the same token to the same endpoint
+
+	GELF      bool             // formats entries as GELF 1.1 JSON instead of logrus JSON, see GELFFormatter
+	Formatter logrus.Formatter // replaces the default JSON formatter, e.g. a logrus.TextFormatter for key=value parsing rules; DataKey doesn't apply to it
+
+	AddRegionField bool   // attaches the region the hook was created for to every entry; skipped when there is no region (NewWithConn)
+	RegionField    string // defaults to "region"; the field AddRegionField uses
+
+	ErrorClassifier func(*logrus.Entry) string // derives a stable class for Error level and above entries, e.g. the message with ids stripped, for alert grouping
+	ErrorClassField string                     // defaults to "error_class"; the field ErrorClassifier's result goes in. Empty results are left out
+
+	RedactFields []string                                              // field names (any case) whose values are replaced with "[REDACTED]" before shipping, e.g. "password"
+	RedactFunc   func(key string, val interface{}) (interface{}, bool) // masks other fields, e.g. keeping the last 4 digits; return true to replace val
+
+	TransformEntry func(*logrus.Entry) *logrus.Entry // runs last before formatting, on the hook's own copy of the entry, for changes no option covers; returning nil drops the entry
+
+	Async           bool            // queues formatted entries for a background writer, so Fire never waits on the network; Fire then only returns formatting errors
+	QueueSize       int             // defaults to 1000; how many entries Async buffers
+	QueueFullPolicy QueueFullPolicy // defaults to DropNewest; what Async does with an entry when the queue is full
+
+	BatchSize          int           // when above 1, up to this many entries are written together in one write, each line still token-prefixed. Fire then only returns the error of a batch it fills
+	BatchFlushInterval time.Duration // defaults to 1s; how long a partly filled batch waits before it's written anyway
+	BatchWritev        bool          // writes a batch's lines with one writev instead of copying them into one buffer first; only plain tcp and unix connections support it, others still get a single copied write
+
+	FlushOnMemPressure   bool   // with BatchSize, writes the current batch early whenever the heap (runtime.MemStats.HeapAlloc, read every second) is above MemPressureHeapBytes
+	MemPressureHeapBytes uint64 // the heap size above which FlushOnMemPressure flushes; required with it
 }
 
+// RequiredFieldsPolicy selects how entries missing one of Opts.RequiredFields are handled
+type RequiredFieldsPolicy int
+
+const (
+	DropMissingRequired RequiredFieldsPolicy = iota // the entry is not shipped and is counted in Stats
+	MarkMissingRequired                             // the entry is shipped with the missing field names under "missing_required"
+)
+
+// WriteTimeoutPolicy selects what happens to a write that times out. Unlike a reset connection, some of its bytes may
+// have reached the server, so each policy trades duplicates against loss differently. The connection is closed in
+// every case.
+type WriteTimeoutPolicy int
+
+const (
+	WriteTimeoutFail  WriteTimeoutPolicy = iota // the write fails like any other, going to Opts.Fallback if set
+	WriteTimeoutRetry                           // the write is retried once on a new connection, so entries are delivered at least once; pair it with Opts.AddEventID to spot duplicates
+	WriteTimeoutDrop                            // the write fails but isn't handed to Opts.Fallback, so an entry that may have landed isn't delivered twice
+)
+
+const (
+	missingRequiredKey  = "missing_required"
+	defaultEventIDField = "event_id"
+	defaultRegionField  = "region"
+	defaultErrorClass   = "error_class"
+)
+
+const (
+	defaultWriteTimeout        = 5 * time.Second
+	defaultStartupProbeBackoff = 100 * time.Millisecond
+)
+
+// TagSource detects runtime metadata to attach to every entry. Values that can't be detected should be left out
+type TagSource func() logrus.Fields
+
 type UnencryptedConnectionConfig struct {
 	Type string `default:"tcp"` // defaults to tcp; valid options are tcp and udp
 	Port int    `default:"514"` // defaults to 514; valid options are 80, 514, and 10000
 	Host string `default:""`    // defaults to empty string; you should specify your target host if using a hub
 }
 
+// Regions are the InsightOps data regions New accepts; each is reached at <region>.data.logs.insight.rapid7.com
+var Regions = []string{"eu", "us", "au", "ca", "ap", "jp"}
+
 const (
 	hostPostfix = ".data.logs.insight.rapid7.com"
 	tlsPort     = 443
+
+	defaultCloudEventsSource = "insightops-logrus"
+	defaultCloudEventsType   = "com.rapid7.insightops.log"
 )
 
+// TokenEnv is the environment variable NewFromEnv reads the token from
+const TokenEnv = "INSIGHTOPS_TOKEN"
+
+// NewFromEnv is New with the token read from the INSIGHTOPS_TOKEN environment variable
+func NewFromEnv(region string, options *Opts) (*InsightOpsHook, error) {
+	return New(os.Getenv(TokenEnv), region, options)
+}
+
 // New
 // creates and returns a `Logrus` hook for InsightOps Token-based logging
 // ref: https://docs.rapid7.com/insightops/token-tcp
 func New(token string, region string, options *Opts) (hook *InsightOpsHook, err error) {
-	if token == "" {
-		err = fmt.Errorf("unable to create new hook: a Token is required")
+	// a datahub agent may add the token itself, in which case the hook sends lines without one
+	agentAddsToken := options != nil && options.DatahubConfig != nil && !options.SendToken
+	if token == "" && !agentAddsToken {
+		err = configError("Token", ErrTokenRequired, "a Token is required")
 		return nil, err
 	}
-	if region == "" || (region != "eu" && region != "us") {
-		err = fmt.Errorf("unable to create new hook: a Region is required and must be eu or us")
+	if token != "" && !isUUID(token) && (options == nil || !options.SkipTokenValidation) {
+		// the token isn't echoed back, as it may be a real one with a typo
+		err = configError("Token", ErrInvalidToken, "the Token must be a UUID like 00000000-0000-0000-0000-000000000000; set SkipTokenValidation if your datahub expects another format")
+		return nil, err
+	}
+	// an explicit endpoint doesn't need a region to find it
+	endpointHost := options != nil && options.EndpointHost != ""
+	if !endpointHost && !slices.Contains(Regions, region) {
+		err = configError("Region", ErrInvalidRegion, "a Region is required and must be one of %s", strings.Join(Regions, ", "))
 		return nil, err
 	}
 
 	// Set the target host
-	hook = &InsightOpsHook{
-		encrypt:   true,
-		token:     token,
-		levels:    logrus.AllLevels,
-		formatter: &logrus.JSONFormatter{},
-		network:   "tcp",
-		host:      region + hostPostfix,
-		port:      tlsPort,
+	hook = newHook(token)
+	hook.encrypt = true
+	hook.network = "tcp"
+	hook.host = region + hostPostfix
+	hook.port = tlsPort
+	hook.region = region
+
+	httpTransport := options != nil && options.Transport == TransportHTTP
+	if httpTransport {
+		hook.host = region + httpHostPostfix
 	}
 
 	if options != nil {
-		hook.formatter.TimestampFormat = time.RFC3339
-		hook.levels = logrus.AllLevels[:options.Priority+1]
+		if options.Compression != CompressionNone && !httpTransport {
+			return nil, configError("Compression", ErrInvalidOption, "Compression is only supported with TransportHTTP")
+		}
+		hook.compression = options.Compression
+		if options.Compression == CompressionZstd && options.ZstdEncoder == nil {
+			return nil, configError("ZstdEncoder", ErrInvalidOption, "CompressionZstd needs a ZstdEncoder")
+		}
+		hook.zstdEncoder = options.ZstdEncoder
+		if options.CompressMinBatchBytes < 0 {
+			return nil, configError("CompressMinBatchBytes", ErrInvalidOption, "CompressMinBatchBytes can't be negative")
+		}
+		hook.compressMin = options.CompressMinBatchBytes
+		if httpTransport {
+			if err = validateHTTPOptions(options); err != nil {
+				return nil, err
+			}
+		}
+		if options.EndpointPort < 0 || options.EndpointPort > 65535 {
+			return nil, configError("EndpointPort", ErrInvalidOption, "EndpointPort %d is not a valid port", options.EndpointPort)
+		}
+		if options.EndpointHost != "" {
+			hook.host = options.EndpointHost
+		}
+		if options.EndpointPort != 0 {
+			hook.port = options.EndpointPort
+		}
 
 		// Datahub config
 		if options.DatahubConfig != nil {
+			if options.EndpointHost != "" || options.EndpointPort != 0 {
+				return nil, configError("DatahubConfig", ErrInvalidOption, "EndpointHost and EndpointPort can't be combined with a Datahub config, which sets its own")
+			}
+			if httpTransport {
+				return nil, configError("DatahubConfig", ErrInvalidOption, "TransportHTTP can't be combined with a Datahub config")
+			}
 			if options.DatahubConfig.Host == "" {
-				return nil, fmt.Errorf("unable to create new hook: a Datahub config must contain a Host target")
+				return nil, configError("DatahubConfig.Host", ErrDatahubHostRequired, "a Datahub config must contain a Host target")
 			}
 			if options.DatahubConfig.Type == "" || (options.DatahubConfig.Type != "tcp" && options.DatahubConfig.Type != "udp") {
 				options.DatahubConfig.Type = "tcp"
@@ -88,77 +400,1015 @@ func New(token string, region string, options *Opts) (hook *InsightOpsHook, err
 		if hook.encrypt && options.TlsConfig != nil {
 			hook.tlsConfig = options.TlsConfig
 		}
+		if options.MinTLSVersion != 0 {
+			hook.minTLSVersion = options.MinTLSVersion
+		}
+		hook.pinnedCerts = options.PinnedCertSHA256
+
+		hook.dialer.Resolver = options.Resolver
+		hook.staticHosts = options.StaticHosts
+		resolver := net.DefaultResolver
+		if options.Resolver != nil {
+			resolver = options.Resolver
+		}
+		if options.RotateAddresses {
+			hook.lookupHost = resolver.LookupHost
+		}
+		if options.ReResolveInterval > 0 {
+			hook.resolveHost = resolver.LookupHost
+		}
+
+		if options.ProxyProtocol != "" {
+			if options.ProxyProtocol != proxyProtocolV1 && options.ProxyProtocol != proxyProtocolV2 {
+				return nil, configError("ProxyProtocol", ErrInvalidOption, "ProxyProtocol must be v1 or v2")
+			}
+			if hook.network != "tcp" {
+				return nil, configError("ProxyProtocol", ErrInvalidOption, "ProxyProtocol is only supported over tcp")
+			}
+			hook.proxyProtocol = options.ProxyProtocol
+		}
+		if options.Backoff != nil {
+			hook.backoff = newBackoff(*options.Backoff)
+		}
 	}
 
-	// Test connection
-	if conn, err := hook.netConnect(); err == nil {
-		err := conn.Close()
-		if err != nil {
-			return nil, err
+	if err = hook.applyOptions(options); err != nil {
+		return nil, err
+	}
+
+	if httpTransport {
+		// the token goes in the URL instead of in each line
+		hook.httpURL = hook.httpIngestURL(token)
+		hook.token = ""
+		hook.httpClient = options.HTTPClient
+		if hook.httpClient == nil {
+			hook.httpClient = hook.newHTTPClient()
+		}
+	}
+	if hook.resolveHost != nil && hook.reResolvable() {
+		hook.startReResolver(options.ReResolveInterval)
+	}
+
+	var n int
+	hook.destination, n = registerDestination(token, hook.network, hook.host, hook.port)
+	if n > 1 && options != nil && options.WarnOnDuplicate {
+		hook.reportError(fmt.Errorf("%d hooks ship with the same token to %s:%d; every entry may be delivered more than once", n, hook.host, hook.port))
+	}
+
+	// Test connection, keeping it (or a full pool when prewarming) to warm the pool
+	switch {
+	case httpTransport && options.HTTPClient != nil:
+		// the caller's client does its own dialing, opening a connection with the first request
+	case options != nil:
+		err = hook.probe(options.PrewarmPool, options.StartupProbeRetries, options.StartupProbeBackoff)
+	default:
+		err = hook.probe(false, 0, 0)
+	}
+	if err != nil {
+		if options != nil && options.FailOnConnectError {
+			hook.FlushAndClose()
+			return nil, fmt.Errorf("unable to create new hook: test connection failed: %w", err)
+		}
+		return hook, nil
+	}
+
+	if options != nil && options.EmitStartupMarker {
+		if err := hook.emitStartupMarker(); err != nil {
+			hook.reportError(err)
 		}
 	}
 
 	return
 }
 
-// Fire formats and sends JSON entry to target service
+// NewWithConn
+// creates and returns a `Logrus` hook writing token-prefixed lines to an already established connection, e.g. a unix
+// socket or a tunnel managed elsewhere. Region, datahub and other connection options are ignored; the hook never
+// dials, so a broken conn is reported through OnError rather than redialed. The caller owns and closes conn.
+func NewWithConn(token string, conn net.Conn, options *Opts) (*InsightOpsHook, error) {
+	if token == "" {
+		return nil, configError("Token", ErrTokenRequired, "a Token is required")
+	}
+	if conn == nil {
+		return nil, configError("conn", ErrConnRequired, "a connection is required")
+	}
+
+	hook := newHook(token)
+	hook.conn = conn
+	if err := hook.applyOptions(options); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// newHook returns a hook with the defaults shared by every constructor
+func newHook(token string) *InsightOpsHook {
+	return &InsightOpsHook{
+		token:             token,
+		levels:            logrus.AllLevels,
+		formatter:         &logrus.JSONFormatter{},
+		pool:              make(chan idleConn, defaultPoolSize),
+		poolSize:          defaultPoolSize,
+		writeTimeout:      defaultWriteTimeout,
+		dialer:            &net.Dialer{},
+		minTLSVersion:     defaultMinTLSVersion,
+		timestampLocation: time.UTC,
+		pipeline:          DefaultEnrichmentPipeline,
+	}
+}
+
+// applyOptions applies the options that don't concern how the hook connects
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) applyOptions(options *Opts) error {
+	if options == nil {
+		return nil
+	}
+
+	// resolve defaulted field names before checking them for clashes
+	names := resolveFieldNames(options)
+	if err := validateFieldNames(options, names); err != nil {
+		return err
+	}
+	if options.PoolSize > maxPoolSize {
+		return configError("PoolSize", ErrInvalidOption, "PoolSize %d exceeds the maximum of %d", options.PoolSize, maxPoolSize)
+	}
+	if options.NoPooling && options.PrewarmPool {
+		return configError("PrewarmPool", ErrInvalidOption, "PrewarmPool and NoPooling can't both be set")
+	}
+	if options.GELF && options.Formatter != nil {
+		return configError("Formatter", ErrInvalidOption, "GELF and Formatter can't both be set")
+	}
+	if options.FlushOnMemPressure && options.BatchSize <= 1 {
+		return configError("FlushOnMemPressure", ErrInvalidOption, "FlushOnMemPressure needs BatchSize, as the batch is the buffer it flushes")
+	}
+	if options.FlushOnMemPressure && options.MemPressureHeapBytes == 0 {
+		return configError("MemPressureHeapBytes", ErrInvalidOption, "FlushOnMemPressure needs MemPressureHeapBytes")
+	}
+	if options.PoolSize > 0 {
+		hook.pool = make(chan idleConn, options.PoolSize)
+		hook.poolSize = options.PoolSize
+	}
+	hook.validateConnOnBorrow = options.ValidateConnOnBorrow
+	hook.noPooling = options.NoPooling
+	hook.prewarmConcurrency = options.PrewarmConcurrency
+
+	jsonFormatter := &logrus.JSONFormatter{TimestampFormat: time.RFC3339}
+	if options.NestFieldsUnder == "" {
+		jsonFormatter.DataKey = options.DataKey
+	}
+	hook.formatter = jsonFormatter
+	if options.GELF {
+		// looked up once here rather than by every Format
+		host, _ := os.Hostname()
+		hook.formatter = &GELFFormatter{Host: host}
+	}
+	if options.Formatter != nil {
+		hook.formatter = options.Formatter
+	}
+	hook.levels = priorityLevels(options.Priority)
+
+	sources := options.AutoTags
+	if options.AddBootID {
+		sources = append(sources[:len(sources):len(sources)], bootTags)
+	}
+	for _, source := range sources {
+		for k, v := range source() {
+			if hook.tags == nil {
+				hook.tags = logrus.Fields{}
+			}
+			hook.tags[k] = v
+		}
+	}
+
+	if options.AddRegionField && hook.region != "" {
+		if hook.tags == nil {
+			hook.tags = logrus.Fields{}
+		}
+		hook.tags[names.region] = hook.region
+	}
+
+	hook.requiredFields = options.RequiredFields
+	hook.requiredFieldsPolicy = options.RequiredFieldsPolicy
+
+	hook.nestFieldsUnder = options.NestFieldsUnder
+	hook.validateJSON = options.ValidateJSON
+	hook.byteSlices = options.ByteSliceEncoding
+	hook.newlineToken = options.CollapseNewlines
+	hook.maxMessageLines = options.MaxMessageLines
+	if options.EnrichmentPipeline != nil {
+		hook.pipeline = options.EnrichmentPipeline
+	}
+	hook.bytePreviewLen = options.ByteSlicePreviewBytes
+	if hook.bytePreviewLen <= 0 {
+		hook.bytePreviewLen = defaultBytePreviewLen
+	}
+	hook.onDelivered = options.OnBatchDelivered
+	hook.addGoroutineID = options.AddGoroutineID
+	hook.errorClassifier = options.ErrorClassifier
+	hook.errorClassField = names.errorClass
+	hook.fireDeadline = options.FireDeadline
+	hook.timeoutPolicy = options.WriteTimeoutPolicy
+	if options.WriteTimeout != 0 {
+		hook.writeTimeout = max(options.WriteTimeout, 0)
+	}
+	if options.MaxConcurrentFires > 0 {
+		hook.fireSlots = make(chan struct{}, options.MaxConcurrentFires)
+		hook.fireSlotWait = options.FireAdmissionWait
+	}
+	if options.MaxLinesPerSecond > 0 {
+		hook.rateLimiter = newRateLimiter(options.MaxLinesPerSecond, options.BurstSize)
+		hook.rateLimitPolicy = options.RateLimitPolicy
+	}
+	if options.AddEventID {
+		hook.eventIDField = names.eventID
+	}
+	hook.sendInvalidJSON = options.SendInvalidJSON
+	if options.OmitEmpty {
+		hook.omitEmpty = options.OmitEmptyKinds
+		if hook.omitEmpty == 0 {
+			hook.omitEmpty = EmptyNil | EmptyString
+		}
+	}
+	hook.onError = options.OnError
+	hook.fallback = options.Fallback
+	hook.fallbackToken = hook.token
+	for _, field := range options.RedactFields {
+		if hook.redactFields == nil {
+			hook.redactFields = map[string]struct{}{}
+		}
+		hook.redactFields[strings.ToLower(field)] = struct{}{}
+	}
+	hook.redactFunc = options.RedactFunc
+	hook.transformEntry = options.TransformEntry
+	if options.BatchSize > 1 {
+		hook.batchSize = options.BatchSize
+		hook.counters.batchSizes = make([]atomic.Uint64, options.BatchSize+1)
+		hook.batchInterval = options.BatchFlushInterval
+		hook.batchWritev = options.BatchWritev
+		if hook.batchInterval <= 0 {
+			hook.batchInterval = defaultBatchFlushInterval
+		}
+	}
+	if options.TimestampLocation != nil {
+		hook.timestampLocation = options.TimestampLocation
+	}
+	hook.originalTimestampField = options.OriginalTimestampField
+
+	if options.CloudEvents {
+		hook.cloudEvents = true
+		hook.cloudEventsSource = options.CloudEventsSource
+		if hook.cloudEventsSource == "" {
+			hook.cloudEventsSource = defaultCloudEventsSource
+		}
+		hook.cloudEventsType = options.CloudEventsType
+		if hook.cloudEventsType == "" {
+			hook.cloudEventsType = defaultCloudEventsType
+		}
+	}
+
+	// background goroutines start last, so an invalid option can't leave one behind
+	if options.IdleTimeout > 0 {
+		hook.idleTimeout = options.IdleTimeout
+		// the HTTP transport's client closes its own idle connections, see newHTTPClient
+		if options.Transport != TransportHTTP {
+			hook.startReaper(options.IdleTimeout)
+		}
+	}
+	if options.Async {
+		hook.startQueue(options.QueueSize, options.QueueFullPolicy)
+	}
+	if options.FlushOnMemPressure {
+		hook.startMemPressureCheck(options.MemPressureHeapBytes)
+	}
+
+	return nil
+}
+
+// Fire formats and sends JSON entry to target service.
+// Write failures are reported and also returned, so logrus (which prints them to stderr) and wrapping loggers can see
+// delivery failed. Entries dropped on purpose, by level, policy or admission control, return nil.
 //
 //goland:noinspection GoMixedReceiverTypes
 func (hook *InsightOpsHook) Fire(entry *logrus.Entry) error {
+	return hook.FireCtx(context.Background(), entry)
+}
+
+// FireCtx is Fire with the dial and write cancelled when ctx is done, e.g. along with the request being logged.
+// In Async mode ctx only covers queueing, cutting short a wait for room under the Block policy, as the write happens
+// later on the background writer.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) FireCtx(ctx context.Context, entry *logrus.Entry) (err error) {
+	// logging must never take the process down, so panics from formatters and callbacks are reported instead
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered panic in insightops hook: %v", r)
+			hook.reportError(err)
+		}
+	}()
+
+	start := time.Now()
+
+	if !hook.levelEnabled(entry.Level) {
+		hook.counters.filteredByLevel.Add(1)
+		return nil
+	}
+	if hook.fireSlots != nil {
+		if !hook.admitFire() {
+			hook.counters.droppedOverload.Add(1)
+			return nil
+		}
+		defer func() { <-hook.fireSlots }()
+	}
+	if hook.requiredFieldsPolicy == DropMissingRequired && len(hook.missingRequired(entry)) > 0 {
+		hook.counters.droppedRequiredFields.Add(1)
+		return nil
+	}
+	// ahead of formatting, so a log storm doesn't spend CPU on entries that won't ship
+	if hook.rateLimiter != nil && !hook.rateLimit(ctx) {
+		hook.counters.droppedRateLimit.Add(1)
+		return nil
+	}
+
 	line, err := hook.format(entry)
+	if errors.Is(err, errDroppedByTransform) {
+		hook.counters.droppedTransform.Add(1)
+		return nil
+	}
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "unable to read entry | err: %v | entry: %+v\n", err, entry)
+		hook.reportError(fmt.Errorf("unable to read entry | err: %w | entry: %+v", err, entry))
 		return err
 	}
 
-	if err = hook.write(line); err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "unable to write to conn | err: %v | line: %s\n", err, line)
+	if hook.validateJSON && !json.Valid([]byte(line)) {
+		hook.reportError(fmt.Errorf("formatted entry is not valid JSON | line: %s", line))
+		if !hook.sendInvalidJSON {
+			hook.counters.droppedInvalidJSON.Add(1)
+			return nil
+		}
+	}
+
+	if hook.queue != nil {
+		hook.enqueue(ctx, line, entry.Level)
+		return nil
+	}
+	return hook.deliver(ctx, line, entry.Level, start)
+}
+
+// deliver writes a formatted line, bounded by Opts.FireDeadline from start, reporting the outcome
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) deliver(ctx context.Context, line string, level logrus.Level, start time.Time) error {
+	var deadline time.Time
+	if hook.fireDeadline > 0 {
+		deadline = start.Add(hook.fireDeadline)
+	}
+
+	if hook.batchSize > 1 {
+		return hook.addToBatch(ctx, line, level, deadline)
+	}
+
+	if err := hook.writeLine(ctx, line, deadline); err != nil {
+		if !deadline.IsZero() && isTimeout(err) {
+			hook.counters.droppedDeadline.Add(1)
+			err = fmt.Errorf("fire deadline of %s exceeded: %w", hook.fireDeadline, err)
+		}
+		hook.counters.failed.Add(1)
+		hook.reportError(fmt.Errorf("unable to write to conn | err: %w | line: %s", err, line))
+		if hook.writeFallback(err, line) {
+			return nil
+		}
+		return err
+	}
+	hook.counters.sent.Add(1)
+	hook.counters.bytesWritten.Add(uint64(len(hook.token) + len(line)))
+	hook.counters.shipped(level)
+	if hook.onDelivered != nil {
+		hook.onDelivered(1, len(hook.token)+len(line))
 	}
 
 	return nil
 }
 
-// Levels returns the log-levels supported by this hook
+// writeFallback writes lines that failed to write with cause to Opts.Fallback, each prefixed with the token, reporting
+// whether it took them. Timeouts are kept out of it under WriteTimeoutDrop.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) writeFallback(cause error, lines ...string) bool {
+	if hook.fallback == nil || hook.timeoutPolicy == WriteTimeoutDrop && isTimeout(cause) {
+		return false
+	}
+
+	var data []byte
+	for _, line := range lines {
+		data = append(data, hook.fallbackToken...)
+		data = append(data, line...)
+	}
+
+	hook.fallbackMutex.Lock()
+	defer hook.fallbackMutex.Unlock()
+	if _, err := hook.fallback.Write(data); err != nil {
+		hook.reportError(fmt.Errorf("unable to write to fallback | err: %w", err))
+		return false
+	}
+	hook.counters.fellBack.Add(uint64(len(lines)))
+	return true
+}
+
+// admitFire takes one of the Opts.MaxConcurrentFires slots, waiting up to Opts.FireAdmissionWait for one to free up
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) admitFire() bool {
+	select {
+	case hook.fireSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if hook.fireSlotWait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(hook.fireSlotWait)
+	defer timer.Stop()
+	select {
+	case hook.fireSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// WillShip reports whether entry would currently pass the hook's level, required-field and RateLimitDrop checks,
+// without counting it or taking from the rate limit, so callers can skip expensive work for entries that won't be
+// shipped.
+// It is advisory: the level range can change (see SetPriority) and other entries can use up the rate limit between
+// calling WillShip and the entry being fired, and delivery can still fail.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) WillShip(entry *logrus.Entry) bool {
+	if !hook.levelEnabled(entry.Level) {
+		return false
+	}
+	if hook.requiredFieldsPolicy == DropMissingRequired && len(hook.missingRequired(entry)) > 0 {
+		return false
+	}
+	if hook.rateLimiter != nil && hook.rateLimitPolicy == RateLimitDrop && !hook.rateLimiter.peek() {
+		return false
+	}
+	return true
+}
+
+// reportError hands err to Opts.OnError, or prints it to stderr when no handler is set.
+// A panicking handler falls back to stderr too.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) reportError(err error) {
+	if hook.onError != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "recovered panic in insightops OnError: %v | err: %v\n", r, err)
+			}
+		}()
+		hook.onError(err)
+		return
+	}
+	_, _ = fmt.Fprintln(os.Stderr, err)
+}
+
+// Levels returns the log-levels supported by this hook, which is all of them: logrus indexes hooks by level when
+// they're added, so entries outside the range currently shipped (see EnabledLevels) are filtered out by Fire instead,
+// letting SetPriority widen the range later
 //
 //goland:noinspection GoMixedReceiverTypes
 func (hook *InsightOpsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// EnabledLevels returns the levels currently shipped by the hook, set by Opts.Priority and changed by SetPriority
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) EnabledLevels() []logrus.Level {
+	hook.levelsMutex.RLock()
+	defer hook.levelsMutex.RUnlock()
 	return hook.levels
 }
 
+// AttachTo adds the hook to each of the given loggers. One hook can safely be shared by any number of loggers firing
+// concurrently; its configuration is read-only after New and its runtime-adjustable state is synchronised.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) AttachTo(loggers ...*logrus.Logger) {
+	for _, logger := range loggers {
+		if logger != nil {
+			logger.AddHook(hook)
+		}
+	}
+}
+
+// SetPriority changes the inclusive level range shipped by the hook at runtime, with the same semantics as
+// Opts.Priority. It is safe to call while entries are being fired, and takes effect for the next entry fired, whether
+// it narrows or widens the range.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) SetPriority(priority logrus.Level) {
+	levels := priorityLevels(priority)
+	hook.levelsMutex.Lock()
+	hook.levels = levels
+	hook.levelsMutex.Unlock()
+}
+
+// SetLevel is SetPriority, named after logrus.Logger's SetLevel for callers flipping both together, e.g. from a
+// signal handler
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) SetLevel(level logrus.Level) {
+	hook.SetPriority(level)
+}
+
+// SetFormatter replaces the formatter used to serialize entries delivered to InsightOps at runtime, without touching
+// the logger's own formatter. It is safe to call while entries are being fired.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) SetFormatter(formatter logrus.Formatter) {
+	hook.formatterMutex.Lock()
+	hook.formatter = formatter
+	hook.formatterMutex.Unlock()
+}
+
+// getFormatter returns the formatter currently used for delivery
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) getFormatter() logrus.Formatter {
+	hook.formatterMutex.RLock()
+	defer hook.formatterMutex.RUnlock()
+	return hook.formatter
+}
+
+// levelEnabled reports whether level is within the hook's current level range
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) levelEnabled(level logrus.Level) bool {
+	for _, l := range hook.EnabledLevels() {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// priorityLevels returns all levels up to and including priority
+func priorityLevels(priority logrus.Level) []logrus.Level {
+	if int(priority) >= len(logrus.AllLevels) {
+		return logrus.AllLevels
+	}
+	return logrus.AllLevels[:priority+1]
+}
+
+// probe makes New's test connection, keeping it in the pool unless NoPooling is set (or fills the pool when
+// prewarming). A failed attempt is retried up to retries times, waiting backoff (default 100ms) before the first retry
+// and doubling it after each.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) probe(prewarm bool, retries int, backoff time.Duration) (err error) {
+	if backoff <= 0 {
+		backoff = defaultStartupProbeBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		if prewarm {
+			err = hook.prewarm()
+		} else {
+			var conn net.Conn
+			if conn, err = hook.netConnect(); err == nil {
+				if hook.httpClient != nil || hook.noPooling {
+					// the client opens its own connections, and without pooling each write dials afresh, so this one
+					// only shows the endpoint can be reached
+					_ = conn.Close()
+				} else {
+					hook.putConn(conn)
+				}
+			}
+		}
+		if err == nil || attempt >= retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 // netConnect establishes a new connection which caller is responsible for closing
 //
 //goland:noinspection GoMixedReceiverTypes
-func (hook InsightOpsHook) netConnect() (net.Conn, error) {
-	// Connect to InsightOps over tls/tcp
+func (hook *InsightOpsHook) netConnect() (net.Conn, error) {
+	return hook.connect(context.Background(), time.Time{})
+}
+
+// connect establishes a new connection which must be done by deadline (if not zero) and before ctx is done, and which
+// is left with deadline set for subsequent writes
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) connect(ctx context.Context, deadline time.Time) (net.Conn, error) {
+	if hook.backoff != nil {
+		if wait := hook.backoff.remaining(); wait > 0 {
+			return nil, fmt.Errorf("%w: next attempt in %s", ErrBackingOff, wait.Round(time.Millisecond))
+		}
+	}
+
+	ok, reserved := acquireConnSlot()
+	if !ok {
+		return nil, ErrTooManyConnections
+	}
+
+	conn, err := hook.getConnDialer().dial(ctx, deadline)
+	if err != nil {
+		if reserved {
+			releaseConnSlot()
+		}
+		// a caller giving up on its own ctx says nothing about the endpoint
+		if hook.backoff != nil && ctx.Err() == nil {
+			hook.backoff.failed()
+		}
+		return nil, err
+	}
+	if hook.backoff != nil {
+		hook.backoff.succeeded()
+	}
+	if reserved {
+		return &limitedConn{Conn: conn}, nil
+	}
+	return conn, nil
+}
+
+// connDialer opens the connections the hook writes to. The hook itself is the default, dialing the configured endpoint;
+// tests swap in their own to hand out in-memory connections or fail on cue.
+type connDialer interface {
+	dial(ctx context.Context, deadline time.Time) (net.Conn, error)
+}
+
+// getConnDialer returns the connDialer in use
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) getConnDialer() connDialer {
+	if hook.connDialer != nil {
+		return hook.connDialer
+	}
+	return hook
+}
+
+// dial connects to the configured endpoint
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) dial(ctx context.Context, deadline time.Time) (net.Conn, error) {
+	dialer := *hook.dialer
+	dialer.Deadline = deadline
+
+	address := hook.dialAddress()
+	if hook.lookupHost != nil {
+		var err error
+		if address, err = hook.rotateAddress(ctx, address); err != nil {
+			return nil, err
+		}
+	}
+
+	// Connect to InsightOps over udp/tcp, with tls added on top when encrypting
+	conn, err := dialer.DialContext(ctx, hook.network, address)
+	if err != nil {
+		return nil, err
+	}
+	if !deadline.IsZero() {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if hook.proxyProtocol == "" {
+		if hook.encrypt {
+			return tlsHandshake(ctx, conn, hook.clientTLSConfig())
+		}
+		return conn, nil
+	}
+
+	// The PROXY header has to be the first bytes on the wire, ahead of any TLS handshake
+	if err = writeProxyHeader(conn, hook.proxyProtocol); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
 	if hook.encrypt {
-		return tls.Dial(hook.network, fmt.Sprintf("%s:%d", hook.host, hook.port), hook.tlsConfig)
+		return tlsHandshake(ctx, conn, hook.clientTLSConfig())
+	}
+	return conn, nil
+}
+
+// tlsHandshake secures conn, closing it if the handshake fails
+func tlsHandshake(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// dialAddress returns the host:port to dial, substituting a pinned IP from hook.staticHosts when present
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) dialAddress() string {
+	host := hook.host
+	if ip, ok := hook.staticHosts[host]; ok && ip != "" {
+		host = ip
+	}
+	return net.JoinHostPort(host, strconv.Itoa(hook.port))
+}
+
+// rotateAddress resolves the host of address and returns the next of its IPs in turn. Addresses that are already an
+// IP, such as those pinned with StaticHosts, are returned as they are.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) rotateAddress(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return address, nil
+	}
+	addrs, err := hook.lookupHost(ctx, host)
+	if err != nil {
+		return "", err
 	}
-	// Connect to InsightOps over udp/tcp unsecured
-	return net.Dial(hook.network, fmt.Sprintf("%s:%d", hook.host, hook.port))
+	if len(addrs) == 0 {
+		return address, nil
+	}
+	i := (hook.nextAddress.Add(1) - 1) % uint64(len(addrs))
+	return net.JoinHostPort(addrs[i], port), nil
 }
 
-// write creates a connection and writes the given line to InsightOps with hook.token inlined
+// clientTLSConfig returns the tls config to dial with, making sure the ServerName (SNI) is the configured host
+// even when a pinned IP is dialed instead
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) clientTLSConfig() *tls.Config {
+	var config *tls.Config
+	if hook.tlsConfig != nil {
+		config = hook.tlsConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = hook.host
+	}
+	if config.MinVersion < hook.minTLSVersion {
+		config.MinVersion = hook.minTLSVersion
+	}
+	if len(hook.pinnedCerts) > 0 {
+		pinCertificates(config, hook.pinnedCerts)
+	}
+	return config
+}
+
+// write writes the given line to InsightOps with hook.token inlined, over a pooled connection
 //
 //goland:noinspection GoMixedReceiverTypes
 func (hook *InsightOpsHook) write(line string) (err error) {
-	if conn, err := hook.netConnect(); err == nil {
-		defer func(conn net.Conn) {
-			err := conn.Close()
-			if err != nil {
-				//ignore
+	return hook.writeLine(context.Background(), line, time.Time{})
+}
+
+// writeLine is write bounded by deadline, covering both the dial and the write (a zero deadline means no bound), and
+// abandoned when ctx is done
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) writeLine(ctx context.Context, line string, deadline time.Time) error {
+	return hook.writeData(ctx, net.Buffers{[]byte(hook.token + line)}, deadline)
+}
+
+// writeData is writeLine for data that's already token-prefixed, which may hold several lines split across its buffers
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) writeData(ctx context.Context, data net.Buffers, deadline time.Time) (err error) {
+	if hook.isClosed() {
+		return ErrHookClosed
+	}
+
+	if hook.httpClient != nil {
+		return hook.post(ctx, joinBuffers(data), deadline)
+	}
+
+	if hook.conn != nil {
+		hook.connMutex.Lock()
+		defer hook.connMutex.Unlock()
+		_ = hook.conn.SetWriteDeadline(hook.writeDeadline(deadline))
+		defer func() { _ = hook.conn.SetWriteDeadline(time.Time{}) }()
+		return writeConn(ctx, hook.conn, data)
+	}
+
+	generation := hook.poolGeneration.Load()
+	var conn net.Conn
+	var pooled bool
+	if hook.noPooling {
+		conn, err = hook.connect(ctx, deadline)
+	} else {
+		conn, pooled, err = hook.getConn(ctx, deadline)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetWriteDeadline(hook.writeDeadline(deadline))
+	if err = writeConn(ctx, conn, data); err != nil && hook.retryWrite(ctx, err, pooled, deadline) {
+		_ = conn.Close()
+		if conn, err = hook.connect(ctx, deadline); err != nil {
+			return err
+		}
+		hook.counters.reconnects.Add(1)
+		_ = conn.SetWriteDeadline(hook.writeDeadline(deadline))
+		err = writeConn(ctx, conn, data)
+	}
+	if err != nil || hook.noPooling {
+		// the connection can't be trusted after a failed write
+		_ = conn.Close()
+		return err
+	}
+	hook.returnConn(conn, generation)
+	return nil
+}
+
+// retryWrite reports whether a failed write is retried on a fresh connection. A pooled connection's failure is, as
+// idle connections are routinely dropped by the server or a load balancer, and so is a timeout under
+// WriteTimeoutRetry. Nothing is retried once ctx is done or deadline (if not zero) has passed.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) retryWrite(ctx context.Context, err error, pooled bool, deadline time.Time) bool {
+	if ctx.Err() != nil || !deadline.IsZero() && !time.Now().Before(deadline) {
+		return false
+	}
+	if isTimeout(err) {
+		return hook.timeoutPolicy == WriteTimeoutRetry
+	}
+	return pooled
+}
+
+// writeConn writes data to conn, cutting the write short when ctx is done
+func writeConn(ctx context.Context, conn net.Conn, data net.Buffers) error {
+	if ctx.Done() != nil {
+		cut := make(chan struct{})
+		stop := context.AfterFunc(ctx, func() {
+			defer close(cut)
+			_ = conn.SetWriteDeadline(time.Now())
+		})
+		// once started, let the cut finish so the caller can reset the deadline after it
+		defer func() {
+			if !stop() {
+				<-cut
 			}
-		}(conn)
-		_, err = conn.Write([]byte(hook.token + line))
+		}()
+	}
+	if err := writeBuffers(conn, data); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("%w: %v", ctxErr, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeDeadline bounds a write starting now by Opts.WriteTimeout, or by deadline if that comes first
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) writeDeadline(deadline time.Time) time.Time {
+	if hook.writeTimeout > 0 {
+		if d := time.Now().Add(hook.writeTimeout); deadline.IsZero() || d.Before(deadline) {
+			return d
+		}
+	}
+	return deadline
+}
+
+// format serializes entry to JSON. With the built-in formatters the output is byte-for-byte the same for the same
+// entry, as encoding/json sorts the keys of every map, nested ones included; only AddEventID and CloudEvents ids vary.
+func (hook *InsightOpsHook) format(entry *logrus.Entry) (string, error) {
+	if entry = hook.prepare(entry); entry == nil {
+		return "", errDroppedByTransform
+	}
+
+	serialized, err := hook.getFormatter().Format(entry)
+	if err != nil {
+		return "", err
+	}
+	if hook.cloudEvents {
+		if serialized, err = hook.wrapCloudEvent(entry, serialized); err != nil {
+			return "", err
+		}
+	}
+	return frameLine(string(serialized)), nil
+}
+
+// frameLine makes line exactly one event on the wire, which InsightOps delimits by newline: leading whitespace is
+// trimmed so the payload directly follows the token, newlines inside it (from a pretty-printing or custom formatter)
+// become spaces, and it ends in a single newline
+func frameLine(line string) string {
+	line = strings.TrimLeft(line, " \t\r\n")
+	line = strings.TrimRight(line, "\r\n")
+	if strings.ContainsAny(line, "\r\n") {
+		line = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(line)
+	}
+	return line + "\n"
+}
+
+// missingRequired returns the names of the required fields that neither entry nor the hook's tags carry, so every
+// policy sees the fields the entry is shipped with
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) missingRequired(entry *logrus.Entry) (missing []string) {
+	for _, field := range hook.requiredFields {
+		if _, ok := entry.Data[field]; ok {
+			continue
+		}
+		if _, ok := hook.tags[field]; !ok {
+			missing = append(missing, field)
+		}
 	}
 	return
 }
 
-// format serializes entry to JSON
-func (hook InsightOpsHook) format(entry *logrus.Entry) (string, error) {
-	serialized, err := hook.formatter.Format(entry)
+// cloneEntry copies entry with its own Data so it can be modified without affecting other hooks.
+// Entries built by hand rather than through a logger may have a nil Data, Logger and Context; the hook must not
+// rely on any of them being set.
+func cloneEntry(entry *logrus.Entry) *logrus.Entry {
+	clone := *entry
+	clone.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		clone.Data[k] = v
+	}
+	return &clone
+}
+
+// cloudEvent is the CloudEvents 1.0 JSON envelope an entry is wrapped in when Opts.CloudEvents is set
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// wrapCloudEvent wraps the serialized entry in a CloudEvents envelope with a unique id
+func (hook *InsightOpsHook) wrapCloudEvent(entry *logrus.Entry, serialized []byte) ([]byte, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	data := bytes.TrimSpace(serialized)
+	if !json.Valid(data) {
+		// non JSON output is carried as a JSON string
+		if data, err = json.Marshal(string(data)); err != nil {
+			return nil, err
+		}
+	}
+	wrapped, err := json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            hook.cloudEventsType,
+		Source:          hook.cloudEventsSource,
+		ID:              id,
+		Time:            entry.Time.Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            data,
+	})
 	if err != nil {
+		return nil, err
+	}
+	return append(wrapped, '\n'), nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
 		return "", err
 	}
-	str := string(serialized)
-	return str, nil
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// isUUID reports whether s is a UUID in its canonical 8-4-4-4-12 hex form, as InsightOps tokens are
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
 }
@@ -1,13 +1,31 @@
 package insightops_logrus
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -16,8 +34,14 @@ func init() {
 	logrus.SetLevel(logrus.DebugLevel)           // This will affect your stdout level, but not the level for the insightops hook. You specify that priority on creation
 	logrus.SetFormatter(&logrus.JSONFormatter{}) // You can use any formatter; the hook will always format as JSON without interfering with your other hooks
 
+	token := os.Getenv("Insight.Token") // fetching token from env vars here. You can make a token in your insightops account and are expected to have 1 token for each application
+	if token == "" {
+		// no token available (e.g. CI); the live tests below just log locally
+		return
+	}
+
 	hook, err := New(
-		os.Getenv("Insight.Token"), // fetching token from env vars here. You can make a token in your insightops account and are expected to have 1 token for each application
+		token,
 		"eu",
 		&Opts{
 			Priority: logrus.InfoLevel, // log level is inclusive. Setting to logrus.ErrorLevel, for example, would include errors, panics, and fatals, but not info or debug.
@@ -231,3 +255,1684 @@ ReadLoop:
 		}
 	}
 }
+
+// lineServer is a mock InsightOps endpoint listening on an ephemeral loopback port, which reports every line it
+// receives and the TLS server name requested by each client
+type lineServer struct {
+	listener    net.Listener
+	lines       chan string
+	serverNames chan string
+	wg          sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	accepted int
+}
+
+func newLineServer(t *testing.T, tlsConfig *tls.Config) *lineServer {
+	t.Helper()
+	return newLineServerAt(t, "127.0.0.1:0", tlsConfig)
+}
+
+// newLineServerAt is newLineServer listening on a specific address
+func newLineServerAt(t *testing.T, address string, tlsConfig *tls.Config) *lineServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+
+	s := &lineServer{
+		listener:    l,
+		lines:       make(chan string, 100),
+		serverNames: make(chan string, 100),
+		conns:       map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if tlsConfig != nil {
+				conn = tls.Server(conn, tlsConfig)
+			}
+			s.mu.Lock()
+			s.conns[conn] = struct{}{}
+			s.accepted++
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer conn.Close()
+				if tlsConn, ok := conn.(*tls.Conn); ok {
+					if err := tlsConn.Handshake(); err != nil {
+						return
+					}
+					s.serverNames <- tlsConn.ConnectionState().ServerName
+				}
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					s.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func (s *lineServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// ResetConns aborts every accepted connection with a TCP reset, as an idle timeout on the server would, while still
+// accepting new ones
+func (s *lineServer) ResetConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.SetLinger(0)
+		}
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Stop stops accepting and closes every accepted connection
+func (s *lineServer) Stop() {
+	_ = s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// Accepted returns how many connections the server has accepted
+func (s *lineServer) Accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// nextLine waits for the next line received by the server
+func (s *lineServer) nextLine(t *testing.T) string {
+	t.Helper()
+	select {
+	case line := <-s.lines:
+		return line
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for line")
+		return ""
+	}
+}
+
+// newTestCertificate creates a self-signed certificate valid for the given hosts, and a pool trusting it
+func newTestCertificate(t *testing.T, hosts ...string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestStaticHostsDialsPinnedIPWithOriginalServerName(t *testing.T) {
+	host := "eu" + hostPostfix
+	cert, roots := newTestCertificate(t, host)
+	s := newLineServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	hook, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{
+		TlsConfig:   &tls.Config{RootCAs: roots},
+		Resolver:    &net.Resolver{PreferGo: true},
+		StaticHosts: map[string]string{host: "127.0.0.1"},
+	})
+	require.NoError(t, err)
+	hook.port = s.Port()
+
+	assert.Equal(t, "127.0.0.1:"+strconv.Itoa(s.Port()), hook.dialAddress())
+
+	conn, err := hook.netConnect()
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, host, <-s.serverNames)
+	assert.Equal(t, "hello", s.nextLine(t))
+}
+
+func TestEndpointOverride(t *testing.T) {
+	cert, roots := newTestCertificate(t, "localhost")
+	s := newLineServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	// no region is needed with an explicit host
+	hook, err := New("00000000-0000-0000-0000-000000000000", "", &Opts{
+		Priority:           logrus.DebugLevel,
+		EndpointHost:       "localhost",
+		EndpointPort:       s.Port(),
+		TlsConfig:          &tls.Config{RootCAs: roots},
+		FailOnConnectError: true,
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+	assert.True(t, hook.encrypt)
+	assert.Equal(t, "localhost:"+strconv.Itoa(s.Port()), hook.dialAddress())
+	assert.Equal(t, "localhost", <-s.serverNames, "the connection is still TLS")
+
+	newTestLogger(hook).Info("over tls")
+	assert.Equal(t, "over tls", nextPayload(t, s)["msg"])
+
+	// the port alone keeps the region's host
+	hook, err = New("00000000-0000-0000-0000-000000000000", "eu", &Opts{EndpointPort: 8443})
+	require.NoError(t, err)
+	assert.Equal(t, "eu"+hostPostfix+":8443", hook.dialAddress())
+
+	_, err = New("00000000-0000-0000-0000-000000000000", "", &Opts{EndpointPort: 8443})
+	assert.ErrorContains(t, err, "Region is required")
+	_, err = New("00000000-0000-0000-0000-000000000000", "eu", &Opts{EndpointPort: 70000})
+	assert.ErrorContains(t, err, "EndpointPort")
+	_, err = New("00000000-0000-0000-0000-000000000000", "eu", &Opts{
+		EndpointHost:  "localhost",
+		DatahubConfig: &UnencryptedConnectionConfig{Host: "127.0.0.1"},
+	})
+	assert.ErrorContains(t, err, "Datahub")
+}
+
+func TestRotateAddresses(t *testing.T) {
+	hook := newHook("token ")
+	hook.network, hook.host, hook.port = "tcp", "logs.example", 443
+	hook.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		require.Equal(t, "logs.example", host)
+		return []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, nil
+	}
+
+	// record each dialed address, failing the dial before anything goes on the wire
+	errRecorded := errors.New("recorded")
+	var dialed []string
+	hook.dialer.Control = func(network, address string, c syscall.RawConn) error {
+		dialed = append(dialed, address)
+		return errRecorded
+	}
+
+	for i := 0; i < 4; i++ {
+		_, err := hook.dial(context.Background(), time.Time{})
+		require.ErrorIs(t, err, errRecorded)
+	}
+	assert.Equal(t, []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443", "10.0.0.1:443"}, dialed)
+
+	// a pinned IP isn't rotated
+	dialed = nil
+	hook.staticHosts = map[string]string{"logs.example": "10.0.0.9"}
+	_, err := hook.dial(context.Background(), time.Time{})
+	require.ErrorIs(t, err, errRecorded)
+	assert.Equal(t, []string{"10.0.0.9:443"}, dialed)
+}
+
+// newTestHook creates a hook delivering unencrypted to the given mock server
+func newTestHook(t *testing.T, s *lineServer, options *Opts) *InsightOpsHook {
+	t.Helper()
+
+	if options == nil {
+		options = &Opts{}
+	}
+	options.DatahubConfig = &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1"}
+	hook, err := New("00000000-0000-0000-0000-000000000000", "eu", options)
+	require.NoError(t, err)
+	hook.port = s.Port()
+	// drop anything New's test connection pooled, as it went to the default port
+	drainPool(hook)
+	t.Cleanup(hook.FlushAndClose)
+	return hook
+}
+
+// drainPool closes the hook's idle connections, so the next write dials
+func drainPool(hook *InsightOpsHook) {
+	for len(hook.pool) > 0 {
+		_ = (<-hook.pool).Close()
+	}
+}
+
+// newTestLogger creates a logger that only outputs through the given hook
+func newTestLogger(hook logrus.Hook) *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(logrus.TraceLevel)
+	logger.AddHook(hook)
+	return logger
+}
+
+// nextPayload waits for the next line and decodes the JSON following the token
+func nextPayload(t *testing.T, s *lineServer) map[string]interface{} {
+	t.Helper()
+
+	line := s.nextLine(t)
+	require.True(t, strings.HasPrefix(line, "00000000-0000-0000-0000-000000000000"), "line should start with the token")
+	payload := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "00000000-0000-0000-0000-000000000000")), &payload))
+	return payload
+}
+
+func TestCloudEventsEnvelope(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, CloudEvents: true, CloudEventsSource: "/test/service"})
+	logger := newTestLogger(hook)
+
+	logger.WithField("user", "alice").Info("first")
+	logger.WithField("user", "bob").Info("second")
+
+	first := nextPayload(t, s)
+	second := nextPayload(t, s)
+
+	assert.Equal(t, "1.0", first["specversion"])
+	assert.Equal(t, "/test/service", first["source"])
+	assert.Equal(t, defaultCloudEventsType, first["type"])
+	assert.NotEmpty(t, first["time"])
+	assert.NotEmpty(t, first["id"])
+	assert.NotEqual(t, first["id"], second["id"], "ids should be unique per entry")
+
+	data, ok := first["data"].(map[string]interface{})
+	require.True(t, ok, "data should hold the log JSON")
+	assert.Equal(t, "alice", data["user"])
+	assert.Equal(t, "first", data["msg"])
+	assert.Equal(t, "info", data["level"])
+}
+
+func TestAutoTagsAttachDetectedFields(t *testing.T) {
+	t.Setenv("POD_NAME", "api-7d9f")
+	t.Setenv("POD_NAMESPACE", "payments")
+	t.Setenv("POD_IP", "")
+	t.Setenv("NODE_NAME", "")
+
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, AutoTags: []TagSource{KubernetesTags, GCPTags}})
+
+	// detection happens once in New
+	t.Setenv("POD_NAME", "changed")
+
+	entry := logrus.NewEntry(logrus.New()).WithField("k8s_namespace", "overridden")
+	entry.Level = logrus.InfoLevel
+	entry.Message = "tagged"
+	require.NoError(t, hook.Fire(entry))
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "api-7d9f", payload["k8s_pod"])
+	assert.Equal(t, "overridden", payload["k8s_namespace"], "entry fields take precedence over tags")
+	assert.NotContains(t, payload, "k8s_pod_ip")
+	assert.NotContains(t, payload, "gcp_service")
+	assert.NotContains(t, entry.Data, "k8s_pod", "source entry should be untouched")
+}
+
+func TestSetPriority(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.InfoLevel})
+	assert.Equal(t, []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}, hook.EnabledLevels())
+	assert.Equal(t, logrus.AllLevels, hook.Levels(), "the hook is registered for every level, filtering itself")
+
+	hook.SetPriority(logrus.ErrorLevel)
+	assert.Equal(t, []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}, hook.EnabledLevels())
+
+	logger := newTestLogger(hook)
+	logger.Info("filtered after raising priority")
+	logger.Error("shipped")
+	assert.Equal(t, "shipped", nextPayload(t, s)["msg"])
+
+	hook.SetPriority(logrus.TraceLevel)
+	assert.Equal(t, logrus.AllLevels, hook.EnabledLevels())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				hook.SetPriority(logrus.Level(j % len(logrus.AllLevels)))
+				_ = hook.EnabledLevels()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSetLevelWidensRange(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.InfoLevel})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(logrus.DebugLevel)
+	logger.AddHook(hook)
+
+	logger.Debug("filtered")
+	hook.SetLevel(logrus.DebugLevel)
+	logger.Debug("shipped after widening")
+	assert.Equal(t, "shipped after widening", nextPayload(t, s)["msg"])
+
+	stats := hook.Stats()
+	assert.Equal(t, uint64(1), stats.Sent)
+	assert.Equal(t, uint64(1), stats.FilteredByLevel)
+}
+
+func TestTimestampLocation(t *testing.T) {
+	s := newLineServer(t, nil)
+	source := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("UTC+5", 5*60*60))
+
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel})
+	entry := &logrus.Entry{Logger: logrus.New(), Data: logrus.Fields{}, Time: source, Level: logrus.InfoLevel, Message: "default"}
+	require.NoError(t, hook.Fire(entry))
+	assert.Equal(t, "2024-03-01T07:30:00Z", nextPayload(t, s)["time"], "defaults to UTC")
+	assert.Equal(t, source.Location(), entry.Time.Location(), "source entry should be untouched")
+
+	hook = newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, TimestampLocation: time.FixedZone("UTC-3", -3*60*60)})
+	require.NoError(t, hook.Fire(entry))
+	assert.Equal(t, "2024-03-01T04:30:00-03:00", nextPayload(t, s)["time"])
+}
+
+func TestOptsFormatter(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{
+		Priority:  logrus.DebugLevel,
+		Formatter: &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true},
+	})
+
+	newTestLogger(hook).WithFields(logrus.Fields{"user": "alice", "attempt": 2}).Warn("as text")
+	assert.Equal(t, "00000000-0000-0000-0000-000000000000level=warning msg=\"as text\" attempt=2 user=alice", s.nextLine(t))
+
+	_, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{GELF: true, Formatter: &logrus.TextFormatter{}})
+	assert.Error(t, err)
+}
+
+// bareFormatter writes just the message, without a trailing newline
+type bareFormatter struct{}
+
+func (bareFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return []byte(entry.Message), nil
+}
+
+func TestOneEventPerLine(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, Formatter: bareFormatter{}})
+	logger := newTestLogger(hook)
+
+	// without a trailing newline the two would arrive as one event
+	logger.Info("first")
+	logger.Info("second")
+	assert.Equal(t, "00000000-0000-0000-0000-000000000000first", s.nextLine(t))
+	assert.Equal(t, "00000000-0000-0000-0000-000000000000second", s.nextLine(t))
+
+	// embedded newlines would split one event into several
+	logger.Info("stack:\nframe 1\r\nframe 2\n\n")
+	assert.Equal(t, "00000000-0000-0000-0000-000000000000stack: frame 1 frame 2", s.nextLine(t))
+
+	// leading whitespace would separate the token from the payload
+	logger.Info("\n  {\"a\":1}")
+	assert.Equal(t, `00000000-0000-0000-0000-000000000000{"a":1}`, s.nextLine(t))
+
+	// formatters that already end lines aren't doubled up, and pretty printed JSON stays one event
+	hook.SetFormatter(&logrus.JSONFormatter{PrettyPrint: true})
+	logger.WithField("n", 1).Info("pretty")
+	assert.Equal(t, "pretty", nextPayload(t, s)["msg"])
+	logger.Info("next")
+	assert.Equal(t, "next", nextPayload(t, s)["msg"])
+}
+
+func TestSetFormatterAtRuntime(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel})
+	logger := newTestLogger(hook)
+
+	logger.WithField("user", "alice").Info("as json")
+	assert.Equal(t, "as json", nextPayload(t, s)["msg"])
+
+	hook.SetFormatter(&logrus.TextFormatter{DisableColors: true, DisableTimestamp: true})
+	logger.WithField("user", "bob").Info("as text")
+	assert.Equal(t, "00000000-0000-0000-0000-000000000000level=info msg=\"as text\" user=bob", s.nextLine(t))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hook.SetFormatter(&logrus.JSONFormatter{})
+			_ = hook.getFormatter()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRequiredFieldsDrop(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, RequiredFields: []string{"service", "env"}})
+	logger := newTestLogger(hook)
+
+	logger.WithField("service", "api").Info("missing env")
+	logger.WithFields(logrus.Fields{"service": "api", "env": "prod"}).Info("complete")
+
+	assert.Equal(t, "complete", nextPayload(t, s)["msg"])
+	assert.Equal(t, uint64(1), hook.Stats().DroppedRequiredFields)
+}
+
+func TestRequiredFieldsMark(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{
+		Priority:             logrus.DebugLevel,
+		RequiredFields:       []string{"service", "env"},
+		RequiredFieldsPolicy: MarkMissingRequired,
+	})
+	logger := newTestLogger(hook)
+
+	entry := logger.WithField("service", "api")
+	entry.Info("missing env")
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "missing env", payload["msg"])
+	assert.Equal(t, []interface{}{"env"}, payload[missingRequiredKey])
+	assert.NotContains(t, entry.Data, missingRequiredKey)
+	assert.Equal(t, uint64(0), hook.Stats().DroppedRequiredFields)
+}
+
+func TestRequiredFieldsFromTags(t *testing.T) {
+	s := newLineServer(t, nil)
+	tags := func() logrus.Fields { return logrus.Fields{"env": "prod"} }
+	for _, policy := range []RequiredFieldsPolicy{DropMissingRequired, MarkMissingRequired} {
+		hook := newTestHook(t, s, &Opts{
+			Priority:             logrus.DebugLevel,
+			AutoTags:             []TagSource{tags},
+			RequiredFields:       []string{"env"},
+			RequiredFieldsPolicy: policy,
+		})
+		entry := &logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "tagged"}
+		assert.True(t, hook.WillShip(entry))
+		newTestLogger(hook).Info("tagged")
+
+		payload := nextPayload(t, s)
+		assert.Equal(t, "tagged", payload["msg"])
+		assert.Equal(t, "prod", payload["env"])
+		assert.NotContains(t, payload, missingRequiredKey)
+		assert.Equal(t, uint64(0), hook.Stats().DroppedRequiredFields)
+	}
+}
+
+func TestNestFieldsUnder(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, NestFieldsUnder: "fields"})
+	logger := newTestLogger(hook)
+
+	logger.WithFields(logrus.Fields{
+		"user":  "alice",
+		"msg":   "user supplied msg",
+		"error": errors.New("boom"),
+	}).Info("nested")
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "nested", payload["msg"])
+	assert.Equal(t, "info", payload["level"])
+	assert.NotEmpty(t, payload["time"])
+	assert.NotContains(t, payload, "user")
+	assert.Equal(t, map[string]interface{}{
+		"user":  "alice",
+		"msg":   "user supplied msg",
+		"error": "boom",
+	}, payload["fields"])
+}
+
+type panickingFormatter struct{}
+
+func (panickingFormatter) Format(*logrus.Entry) ([]byte, error) {
+	panic("formatter exploded")
+}
+
+func TestFireRecoversPanics(t *testing.T) {
+	s := newLineServer(t, nil)
+	var reported []error
+	hook := newTestHook(t, s, &Opts{
+		Priority: logrus.DebugLevel,
+		OnError:  func(err error) { reported = append(reported, err) },
+	})
+	hook.SetFormatter(panickingFormatter{})
+	logger := newTestLogger(hook)
+
+	assert.NotPanics(t, func() { logger.Info("survives") })
+	require.Len(t, reported, 1)
+	assert.Contains(t, reported[0].Error(), "formatter exploded")
+
+	// a panicking OnError must not escape either
+	hook.onError = func(error) { panic("handler exploded") }
+	assert.NotPanics(t, func() { logger.Info("still survives") })
+}
+
+func TestProxyProtocolV1HeaderPrecedesFirstLine(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, ProxyProtocol: "v1"})
+	logger := newTestLogger(hook)
+
+	logger.Info("behind a proxy")
+
+	header := strings.Fields(strings.TrimSuffix(s.nextLine(t), "\r"))
+	require.Len(t, header, 6)
+	assert.Equal(t, []string{"PROXY", "TCP4", "127.0.0.1", "127.0.0.1"}, header[:4])
+	assert.Equal(t, strconv.Itoa(s.Port()), header[5])
+	assert.Equal(t, "behind a proxy", nextPayload(t, s)["msg"])
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	local := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51234}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443}
+
+	header := proxyHeaderV2(local, remote)
+	assert.Equal(t, proxyV2Signature, header[:12])
+	assert.Equal(t, []byte{0x21, 0x11, 0x00, 0x0C, 10, 0, 0, 1, 10, 0, 0, 2, 0xC8, 0x22, 0x01, 0xBB}, header[12:])
+}
+
+func TestProxyProtocolValidation(t *testing.T) {
+	_, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{ProxyProtocol: "v3"})
+	assert.Error(t, err)
+
+	_, err = New("00000000-0000-0000-0000-000000000000", "eu", &Opts{
+		ProxyProtocol: "v1",
+		DatahubConfig: &UnencryptedConnectionConfig{Type: "udp", Host: "127.0.0.1"},
+	})
+	assert.Error(t, err)
+}
+
+func TestStatsCountDropReasons(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, RequiredFields: []string{"service"}})
+	logger := newTestLogger(hook)
+
+	hook.SetPriority(logrus.InfoLevel)
+	logger.WithField("service", "api").Debug("filtered")
+	logger.Info("missing service")
+	logger.Warn("missing service")
+	logger.WithField("service", "api").Info("shipped")
+
+	assert.Equal(t, "shipped", nextPayload(t, s)["msg"])
+	stats := hook.Stats()
+	assert.Positive(t, stats.BytesWritten)
+	stats.BytesWritten = 0
+	assert.Equal(t, Stats{Sent: 1, Dropped: 2, FilteredByLevel: 1, DroppedRequiredFields: 2}, stats)
+}
+
+func TestStatsCountDelivery(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, OnError: func(error) {}})
+	logger := newTestLogger(hook)
+
+	logger.Info("one")
+	logger.Info("two")
+	received := 0
+	for i := 0; i < 2; i++ {
+		received += len(s.nextLine(t)) + len("\n")
+	}
+	assert.Equal(t, Stats{Sent: 2, BytesWritten: uint64(received)}, hook.Stats())
+
+	// a reset pooled connection is replaced
+	s.ResetConns()
+	time.Sleep(50 * time.Millisecond)
+	logger.Info("three")
+	assert.Equal(t, "three", nextPayload(t, s)["msg"])
+	assert.Equal(t, uint64(3), hook.Stats().Sent)
+	assert.Equal(t, uint64(1), hook.Stats().Reconnects)
+
+	s.Stop()
+	drainPool(hook)
+	logger.Info("lost")
+	assert.Equal(t, uint64(3), hook.Stats().Sent)
+	assert.Equal(t, uint64(1), hook.Stats().Failed)
+}
+
+func TestFallback(t *testing.T) {
+	for _, batchSize := range []int{0, 2} {
+		t.Run(strconv.Itoa(batchSize), func(t *testing.T) {
+			s := newLineServer(t, nil)
+			var fallback bytes.Buffer
+			var reported []error
+			hook := newTestHook(t, s, &Opts{
+				Priority:  logrus.DebugLevel,
+				BatchSize: batchSize,
+				Fallback:  &fallback,
+				OnError:   func(err error) { reported = append(reported, err) },
+			})
+
+			// the endpoint is down
+			s.Stop()
+			for i := 0; i < 4; i++ {
+				require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: strconv.Itoa(i)}))
+			}
+
+			lines := strings.SplitAfter(fallback.String(), "\n")
+			require.Len(t, lines, 5)
+			for i, line := range lines[:4] {
+				require.True(t, strings.HasPrefix(line, "00000000-0000-0000-0000-000000000000"), line)
+				var payload struct{ Msg string }
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "00000000-0000-0000-0000-000000000000")), &payload))
+				assert.Equal(t, strconv.Itoa(i), payload.Msg)
+			}
+			assert.Equal(t, uint64(4), hook.Stats().FellBack)
+			assert.Equal(t, uint64(4), hook.Stats().Failed)
+			assert.Zero(t, hook.Stats().Sent)
+			// the diagnostics still go to OnError rather than the fallback
+			assert.NotEmpty(t, reported)
+		})
+	}
+}
+
+func TestLevelCounts(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.InfoLevel, OnError: func(error) {}})
+	logger := newTestLogger(hook)
+
+	logger.Debug("filtered")
+	logger.Info("one")
+	logger.Info("two")
+	logger.Warn("three")
+	logger.Error("four")
+	for i := 0; i < 4; i++ {
+		s.nextLine(t)
+	}
+
+	counts := hook.LevelCounts()
+	assert.Equal(t, uint64(2), counts[logrus.InfoLevel])
+	assert.Equal(t, uint64(1), counts[logrus.WarnLevel])
+	assert.Equal(t, uint64(1), counts[logrus.ErrorLevel])
+	assert.Zero(t, counts[logrus.DebugLevel])
+	assert.Len(t, counts, len(logrus.AllLevels))
+
+	// failed writes aren't counted
+	s.Stop()
+	drainPool(hook)
+	logger.Info("lost")
+	assert.Equal(t, uint64(2), hook.LevelCounts()[logrus.InfoLevel])
+}
+
+func TestNewWithConn(t *testing.T) {
+	client, server := net.Pipe()
+	var reported []error
+	hook, err := NewWithConn("00000000-0000-0000-0000-000000000000", client, &Opts{
+		Priority: logrus.DebugLevel,
+		OnError:  func(err error) { reported = append(reported, err) },
+	})
+	require.NoError(t, err)
+	logger := newTestLogger(hook)
+
+	lines := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	logger.Info("first")
+	logger.WithField("n", 2).Info("second")
+	assert.Contains(t, <-lines, `00000000-0000-0000-0000-000000000000{"level":"info","msg":"first"`)
+	assert.Contains(t, <-lines, `"msg":"second","n":2`)
+
+	// a broken conn is reported, not redialed
+	require.NoError(t, server.Close())
+	logger.Info("lost")
+	require.Len(t, reported, 1)
+	assert.ErrorIs(t, reported[0], io.ErrClosedPipe)
+
+	_, err = NewWithConn("00000000-0000-0000-0000-000000000000", nil, nil)
+	assert.Error(t, err)
+}
+
+func TestOmitEmptyDropsNilError(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, OmitEmpty: true, OmitEmptyKinds: EmptyNil})
+	logger := newTestLogger(hook)
+
+	logger.WithError(nil).Error("no error after all")
+	assert.NotContains(t, nextPayload(t, s), logrus.ErrorKey)
+
+	logger.WithError(errors.New("boom")).Error("real error")
+	assert.Equal(t, "boom", nextPayload(t, s)[logrus.ErrorKey])
+}
+
+func TestOmitEmpty(t *testing.T) {
+	var nilPointer *int
+	fields := logrus.Fields{
+		"name":       "alice",
+		"empty":      "",
+		"nil":        nil,
+		"nilPointer": nilPointer,
+		"zero":       0,
+		"false":      false,
+		"count":      3,
+		"emptyList":  []string{},
+	}
+
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, OmitEmpty: true})
+	logger := newTestLogger(hook)
+
+	logger.WithFields(fields).Info("default kinds")
+	payload := nextPayload(t, s)
+	for _, key := range []string{"name", "zero", "false", "count", "emptyList"} {
+		assert.Contains(t, payload, key)
+	}
+	for _, key := range []string{"empty", "nil", "nilPointer"} {
+		assert.NotContains(t, payload, key)
+	}
+
+	hook = newTestHook(t, s, &Opts{
+		Priority:       logrus.DebugLevel,
+		OmitEmpty:      true,
+		OmitEmptyKinds: EmptyNil | EmptyString | EmptyZero | EmptyCollection,
+	})
+	newTestLogger(hook).WithFields(fields).Info("all kinds")
+	payload = nextPayload(t, s)
+	for _, key := range []string{"empty", "nil", "nilPointer", "zero", "false", "emptyList"} {
+		assert.NotContains(t, payload, key)
+	}
+	assert.Equal(t, "alice", payload["name"])
+	assert.Equal(t, float64(3), payload["count"])
+}
+
+type brokenJSONFormatter struct{}
+
+func (brokenJSONFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return []byte(`{"msg":"` + entry.Message + "\n"), nil
+}
+
+func TestValidateJSON(t *testing.T) {
+	s := newLineServer(t, nil)
+	var reported []error
+	hook := newTestHook(t, s, &Opts{
+		Priority:     logrus.DebugLevel,
+		ValidateJSON: true,
+		OnError:      func(err error) { reported = append(reported, err) },
+	})
+	logger := newTestLogger(hook)
+
+	hook.SetFormatter(brokenJSONFormatter{})
+	logger.Info("broken")
+	require.Len(t, reported, 1)
+	assert.Contains(t, reported[0].Error(), "not valid JSON")
+	assert.Equal(t, uint64(1), hook.Stats().DroppedInvalidJSON)
+
+	hook.SetFormatter(&logrus.JSONFormatter{})
+	logger.Info("valid")
+	assert.Equal(t, "valid", nextPayload(t, s)["msg"], "the broken line should have been dropped")
+	assert.Len(t, reported, 1)
+
+	hook.sendInvalidJSON = true
+	hook.SetFormatter(brokenJSONFormatter{})
+	logger.Info("sent anyway")
+	assert.Equal(t, `00000000-0000-0000-0000-000000000000{"msg":"sent anyway`, s.nextLine(t))
+	assert.Len(t, reported, 2)
+}
+
+func TestAddEventID(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, AddEventID: true})
+	logger := newTestLogger(hook)
+
+	logger.Info("first")
+	logger.Info("second")
+	first, second := nextPayload(t, s), nextPayload(t, s)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, first[defaultEventIDField])
+	assert.NotEqual(t, first[defaultEventIDField], second[defaultEventIDField])
+
+	hook = newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, AddEventID: true, EventIDField: "dedup_id"})
+	entry := logrus.NewEntry(logrus.New())
+	entry.Level = logrus.InfoLevel
+	line, err := hook.format(entry)
+	require.NoError(t, err)
+	assert.Contains(t, line, `"dedup_id":"`)
+	assert.NotContains(t, entry.Data, "dedup_id")
+}
+
+// attemptConn records every write made to it, failing those after the first failAfter as a connection dropped by the
+// server would
+type attemptConn struct {
+	attempts  *[]string
+	failAfter int
+	writes    int
+}
+
+func (c *attemptConn) Write(b []byte) (int, error) {
+	*c.attempts = append(*c.attempts, string(b))
+	if c.writes++; c.failAfter > 0 && c.writes > c.failAfter {
+		return 0, syscall.ECONNRESET
+	}
+	return len(b), nil
+}
+
+func (c *attemptConn) Read([]byte) (int, error)         { return 0, io.EOF }
+func (c *attemptConn) Close() error                     { return nil }
+func (c *attemptConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *attemptConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *attemptConn) SetDeadline(time.Time) error      { return nil }
+func (c *attemptConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *attemptConn) SetWriteDeadline(time.Time) error { return nil }
+
+// attemptDialer hands out conns, in turn, that record to attempts
+type attemptDialer struct {
+	attempts []string
+	conns    []*attemptConn
+}
+
+func (d *attemptDialer) dial(context.Context, time.Time) (net.Conn, error) {
+	conn := d.conns[0]
+	d.conns = d.conns[1:]
+	conn.attempts = &d.attempts
+	return conn, nil
+}
+
+func TestAddEventIDSurvivesRetry(t *testing.T) {
+	// the first connection takes one line then drops, so the second line is retried on a fresh connection
+	dialer := &attemptDialer{conns: []*attemptConn{{failAfter: 1}, {}}}
+	hook := newHook("token ")
+	hook.connDialer = dialer
+	require.NoError(t, hook.applyOptions(&Opts{Priority: logrus.DebugLevel, AddEventID: true, OnError: func(error) {}}))
+	defer hook.FlushAndClose()
+	logger := newTestLogger(hook)
+
+	logger.Info("warm")
+	logger.Info("retried")
+	require.Len(t, dialer.attempts, 3)
+	assert.Equal(t, uint64(1), hook.Stats().Reconnects)
+
+	eventID := func(attempt string) interface{} {
+		var payload map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(attempt, "token ")), &payload))
+		assert.Equal(t, "retried", payload["msg"])
+		return payload[defaultEventIDField]
+	}
+	failed, succeeded := eventID(dialer.attempts[1]), eventID(dialer.attempts[2])
+	assert.NotEmpty(t, failed)
+	assert.Equal(t, failed, succeeded, "a retried entry keeps its event id, so InsightOps can deduplicate it")
+}
+
+func TestDataKey(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, DataKey: "data"})
+	newTestLogger(hook).WithField("user", "alice").Info("nested natively")
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "nested natively", payload["msg"])
+	assert.Equal(t, map[string]interface{}{"user": "alice"}, payload["data"])
+
+	// NestFieldsUnder takes precedence
+	hook = newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, DataKey: "data", NestFieldsUnder: "fields"})
+	newTestLogger(hook).WithField("user", "bob").Info("nested by the hook")
+
+	payload = nextPayload(t, s)
+	assert.NotContains(t, payload, "data")
+	assert.Equal(t, map[string]interface{}{"user": "bob"}, payload["fields"])
+}
+
+func TestFireHandBuiltEntry(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{
+		Priority:        logrus.DebugLevel,
+		RequiredFields:  []string{"service"},
+		AddEventID:      true,
+		NestFieldsUnder: "fields",
+		OmitEmpty:       true,
+
+		RequiredFieldsPolicy: MarkMissingRequired,
+	})
+
+	entry := &logrus.Entry{Level: logrus.InfoLevel, Message: "x"}
+	assert.NotPanics(t, func() { require.NoError(t, hook.Fire(entry)) })
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "x", payload["msg"])
+	assert.Equal(t, "info", payload["level"])
+	assert.Nil(t, entry.Data)
+}
+
+func TestOnBatchDelivered(t *testing.T) {
+	s := newLineServer(t, nil)
+	var delivered, deliveredBytes int
+	hook := newTestHook(t, s, &Opts{
+		Priority: logrus.DebugLevel,
+		OnBatchDelivered: func(count int, bytes int) {
+			delivered += count
+			deliveredBytes += bytes
+		},
+		OnError: func(error) {},
+	})
+	logger := newTestLogger(hook)
+
+	logger.Info("one")
+	logger.WithField("n", 2).Info("two")
+	logger.Warn("three")
+
+	received := 0
+	for i := 0; i < 3; i++ {
+		received += len(s.nextLine(t)) + len("\n")
+	}
+	assert.Equal(t, 3, delivered)
+	assert.Equal(t, received, deliveredBytes)
+
+	// failed writes aren't reported as delivered
+	s.Stop()
+	drainPool(hook)
+	logger.Info("lost")
+	assert.Equal(t, 3, delivered)
+}
+
+func TestAddRegionField(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, AddRegionField: true})
+	newTestLogger(hook).Info("default field")
+	assert.Equal(t, "eu", nextPayload(t, s)[defaultRegionField])
+
+	hook = newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, AddRegionField: true, RegionField: "insight_region"})
+	newTestLogger(hook).Info("custom field")
+	payload := nextPayload(t, s)
+	assert.Equal(t, "eu", payload["insight_region"])
+	assert.NotContains(t, payload, defaultRegionField)
+
+	// hooks without a region skip the field
+	client, server := net.Pipe()
+	defer server.Close()
+	hook, err := NewWithConn("00000000-0000-0000-0000-000000000000", client, &Opts{Priority: logrus.DebugLevel, AddRegionField: true})
+	require.NoError(t, err)
+	assert.NotContains(t, hook.tags, defaultRegionField)
+}
+
+func TestDefaultFieldNamesLeaveOptsUntouched(t *testing.T) {
+	options := &Opts{
+		Priority:        logrus.DebugLevel,
+		DatahubConfig:   &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1", Port: 514},
+		AddEventID:      true,
+		AddRegionField:  true,
+		ErrorClassifier: func(*logrus.Entry) string { return "" },
+	}
+
+	// the same Opts can be handed to hooks built concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hook, err := New("00000000-0000-0000-0000-000000000000", "eu", options)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer hook.FlushAndClose()
+			assert.Equal(t, defaultEventIDField, hook.eventIDField)
+			assert.Equal(t, "eu", hook.tags[defaultRegionField])
+			assert.Equal(t, defaultErrorClass, hook.errorClassField)
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, options.EventIDField)
+	assert.Empty(t, options.RegionField)
+	assert.Empty(t, options.ErrorClassField)
+}
+
+func TestWillShipMatchesFire(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.InfoLevel, RequiredFields: []string{"service"}, MaxLinesPerSecond: 1, BurstSize: 2})
+	now := time.Now()
+	hook.rateLimiter.now = func() time.Time { return now }
+	logger := newTestLogger(hook)
+
+	cases := []struct {
+		name  string
+		entry *logrus.Entry
+		ships bool
+	}{
+		{"filtered level", &logrus.Entry{Logger: logger, Level: logrus.DebugLevel, Data: logrus.Fields{"service": "api"}}, false},
+		{"missing field", &logrus.Entry{Logger: logger, Level: logrus.InfoLevel, Data: logrus.Fields{}}, false},
+		{"ships", &logrus.Entry{Logger: logger, Level: logrus.ErrorLevel, Data: logrus.Fields{"service": "api"}}, true},
+		{"uses the last of the burst", &logrus.Entry{Logger: logger, Level: logrus.ErrorLevel, Data: logrus.Fields{"service": "api"}}, true},
+		{"rate limited", &logrus.Entry{Logger: logger, Level: logrus.ErrorLevel, Data: logrus.Fields{"service": "api"}}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := hook.Stats()
+			assert.Equal(t, c.ships, hook.WillShip(c.entry))
+			assert.Equal(t, before, hook.Stats(), "WillShip should not count anything")
+
+			c.entry.Message = c.name
+			require.NoError(t, hook.Fire(c.entry))
+			if c.ships {
+				assert.Equal(t, c.name, nextPayload(t, s)["msg"])
+			} else {
+				assert.NotEqual(t, before, hook.Stats(), "the entry should have been dropped")
+			}
+		})
+	}
+}
+
+func TestByteSliceEncoding(t *testing.T) {
+	s := newLineServer(t, nil)
+	payload := []byte("hello, world")
+
+	cases := []struct {
+		encoding ByteSliceEncoding
+		expected string
+	}{
+		{ByteSliceBase64, "aGVsbG8sIHdvcmxk"},
+		{ByteSliceHex, "68656c6c6f2c20776f726c64"},
+		{ByteSliceString, "hello, world"},
+		{ByteSlicePreview, "hello... (12 bytes)"},
+	}
+	for _, c := range cases {
+		hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, ByteSliceEncoding: c.encoding, ByteSlicePreviewBytes: 5})
+		entry := newTestLogger(hook).WithField("body", payload)
+		entry.Info("bytes")
+		assert.Equal(t, c.expected, nextPayload(t, s)["body"])
+		assert.Equal(t, payload, entry.Data["body"])
+	}
+}
+
+func TestCollapseNewlines(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, CollapseNewlines: " | "})
+
+	entry := newTestLogger(hook).WithFields(logrus.Fields{
+		"stack": "line 1\nline 2\r\nline 3\rline 4",
+		"error": errors.New("first\nsecond"),
+		"count": 2,
+	})
+	entry.Error("multi-line fields")
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "line 1 | line 2 | line 3 | line 4", payload["stack"])
+	assert.Equal(t, "first | second", payload["error"])
+	assert.Equal(t, float64(2), payload["count"])
+	assert.Equal(t, "line 1\nline 2\r\nline 3\rline 4", entry.Data["stack"])
+}
+
+func TestMaxMessageLines(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, MaxMessageLines: 10})
+
+	lines := make([]string, 50)
+	for i := range lines {
+		lines[i] = "frame " + strconv.Itoa(i+1)
+	}
+	message := strings.Join(lines, "\n")
+	entry := &logrus.Entry{Time: time.Now(), Level: logrus.ErrorLevel, Message: message}
+	require.NoError(t, hook.Fire(entry))
+
+	msg := nextPayload(t, s)["msg"].(string)
+	assert.Equal(t, 10, strings.Count(msg, "\n"))
+	assert.True(t, strings.HasPrefix(msg, strings.Join(lines[:10], "\n")+"\n"))
+	assert.True(t, strings.HasSuffix(msg, "... (40 more lines truncated)"))
+	assert.Equal(t, message, entry.Message)
+
+	// short messages are left alone
+	require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.ErrorLevel, Message: "one\ntwo"}))
+	assert.Equal(t, "one\ntwo", nextPayload(t, s)["msg"])
+}
+
+func TestFireDeadline(t *testing.T) {
+	// accepts tcp connections but never answers the TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	var reported []error
+	hook, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{
+		Priority:     logrus.DebugLevel,
+		StaticHosts:  map[string]string{"eu" + hostPostfix: "127.0.0.1"},
+		FireDeadline: 100 * time.Millisecond,
+		OnError:      func(err error) { reported = append(reported, err) },
+	})
+	require.NoError(t, err)
+	hook.port = l.Addr().(*net.TCPAddr).Port
+
+	start := time.Now()
+	newTestLogger(hook).Info("stalled")
+	elapsed := time.Since(start)
+
+	assert.Less(t, elapsed, time.Second)
+	assert.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	assert.Equal(t, uint64(1), hook.Stats().DroppedDeadline)
+	require.Len(t, reported, 1)
+	assert.Contains(t, reported[0].Error(), "fire deadline")
+}
+
+func TestSharedHookAcrossLoggers(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, AddEventID: true, RequiredFields: []string{"n"}})
+
+	loggers := make([]*logrus.Logger, 4)
+	for i := range loggers {
+		loggers[i] = logrus.New()
+		loggers[i].SetOutput(io.Discard)
+	}
+	hook.AttachTo(append(loggers, nil)...)
+
+	const perLogger = 25
+	var wg sync.WaitGroup
+	for i, logger := range loggers {
+		wg.Add(1)
+		go func(i int, logger *logrus.Logger) {
+			defer wg.Done()
+			for j := 0; j < perLogger; j++ {
+				logger.WithField("n", j).Infof("logger %d", i)
+				if j == perLogger/2 {
+					hook.SetPriority(logrus.DebugLevel)
+					hook.SetFormatter(&logrus.JSONFormatter{})
+					_ = hook.Stats()
+				}
+			}
+		}(i, logger)
+	}
+	wg.Wait()
+
+	for i := 0; i < len(loggers)*perLogger; i++ {
+		s.nextLine(t)
+	}
+}
+
+func TestOriginalTimestampField(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{
+		Priority:               logrus.DebugLevel,
+		TimestampLocation:      time.UTC,
+		OriginalTimestampField: "source_time",
+	})
+
+	source := time.Date(2024, 3, 1, 12, 30, 15, 123456789, time.FixedZone("UTC+5", 5*60*60))
+	require.NoError(t, hook.Fire(&logrus.Entry{Time: source, Level: logrus.InfoLevel, Message: "skewed"}))
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "2024-03-01T07:30:15Z", payload["time"])
+	assert.Equal(t, "2024-03-01T12:30:15.123456789+05:00", payload["source_time"])
+
+	rewritten, err := time.Parse(time.RFC3339, payload["time"].(string))
+	require.NoError(t, err)
+	original, err := time.Parse(time.RFC3339Nano, payload["source_time"].(string))
+	require.NoError(t, err)
+	assert.True(t, original.Truncate(time.Second).Equal(rewritten))
+}
+
+// slowFormatter tracks how many Format calls run at once
+type slowFormatter struct {
+	inFlight, maxInFlight atomic.Int32
+}
+
+func (f *slowFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	n := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		max := f.maxInFlight.Load()
+		if n <= max || f.maxInFlight.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return (&logrus.JSONFormatter{}).Format(entry)
+}
+
+func TestMaxConcurrentFires(t *testing.T) {
+	const fires = 40
+
+	run := func(t *testing.T, wait time.Duration) (*InsightOpsHook, *slowFormatter) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = server.Close() })
+		go func() { _, _ = io.Copy(io.Discard, server) }()
+
+		hook, err := NewWithConn("00000000-0000-0000-0000-000000000000", client, &Opts{
+			Priority:           logrus.DebugLevel,
+			MaxConcurrentFires: 2,
+			FireAdmissionWait:  wait,
+		})
+		require.NoError(t, err)
+		formatter := &slowFormatter{}
+		hook.SetFormatter(formatter)
+		logger := newTestLogger(hook)
+
+		var wg sync.WaitGroup
+		for i := 0; i < fires; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				logger.Info("storm")
+			}()
+		}
+		wg.Wait()
+		return hook, formatter
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		hook, formatter := run(t, 0)
+		assert.LessOrEqual(t, formatter.maxInFlight.Load(), int32(2))
+		assert.Greater(t, hook.Stats().DroppedOverload, uint64(0))
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		hook, formatter := run(t, 5*time.Second)
+		assert.LessOrEqual(t, formatter.maxInFlight.Load(), int32(2))
+		assert.Equal(t, uint64(0), hook.Stats().DroppedOverload)
+	})
+}
+
+func TestFieldNameConflicts(t *testing.T) {
+	conflicts := []struct {
+		name    string
+		options Opts
+		message string
+	}{
+		{"event id and region", Opts{AddEventID: true, EventIDField: "id", AddRegionField: true, RegionField: "id"}, `EventIDField and RegionField both use the field "id"`},
+		{"default event id", Opts{AddEventID: true, OriginalTimestampField: "event_id"}, `EventIDField and OriginalTimestampField both use the field "event_id"`},
+		{"reserved key", Opts{OriginalTimestampField: "time"}, `the formatter and OriginalTimestampField both use the field "time"`},
+		{"nesting key", Opts{AddRegionField: true, NestFieldsUnder: "region"}, `RegionField and NestFieldsUnder both use the field "region"`},
+		{"data key", Opts{DataKey: "msg"}, `the formatter and DataKey both use the field "msg"`},
+	}
+	for _, c := range conflicts {
+		t.Run(c.name, func(t *testing.T) {
+			options := c.options
+			_, err := New("00000000-0000-0000-0000-000000000000", "eu", &options)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), c.message)
+		})
+	}
+
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{
+		Priority:               logrus.DebugLevel,
+		AddEventID:             true,
+		AddRegionField:         true,
+		OriginalTimestampField: "source_time",
+		DataKey:                "data",
+		NestFieldsUnder:        "fields",
+	})
+	newTestLogger(hook).Info("no conflicts")
+	assert.Contains(t, nextPayload(t, s), "fields")
+}
+
+// datahubTestPort is the only allowed datahub port not needing root, used by tests that need New's test connection to
+// reach a mock server
+const datahubTestPort = 10000
+
+func TestFailOnConnectError(t *testing.T) {
+	options := func(fail bool) *Opts {
+		return &Opts{
+			DatahubConfig:      &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1", Port: datahubTestPort},
+			FailOnConnectError: fail,
+		}
+	}
+
+	hook, err := New("00000000-0000-0000-0000-000000000000", "eu", options(false))
+	require.NoError(t, err, "the dial error is swallowed by default")
+	require.NotNil(t, hook)
+
+	_, err = New("00000000-0000-0000-0000-000000000000", "eu", options(true))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "test connection failed")
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestStartupProbeRetries(t *testing.T) {
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(datahubTestPort))
+	options := &Opts{
+		DatahubConfig:       &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1", Port: datahubTestPort},
+		FailOnConnectError:  true,
+		StartupProbeRetries: 3,
+		StartupProbeBackoff: 100 * time.Millisecond,
+	}
+
+	// attempts are made at about 0, 100 and 300ms; the endpoint only comes up after the second
+	started := make(chan *lineServer, 1)
+	time.AfterFunc(180*time.Millisecond, func() { started <- newLineServerAt(t, address, nil) })
+
+	hook, err := New("00000000-0000-0000-0000-000000000000", "eu", options)
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+	s := <-started
+	assert.Eventually(t, func() bool { return s.Accepted() == 1 }, time.Second, time.Millisecond)
+	assert.Len(t, hook.pool, 1)
+
+	// retries run out against an endpoint that stays down
+	s.Stop()
+	options.StartupProbeRetries = 1
+	start := time.Now()
+	_, err = New("00000000-0000-0000-0000-000000000000", "eu", options)
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestNewWarmsPoolWithTestConnection(t *testing.T) {
+	s := newLineServerAt(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(datahubTestPort)), nil)
+	hook, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{
+		Priority:           logrus.DebugLevel,
+		DatahubConfig:      &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1", Port: datahubTestPort},
+		FailOnConnectError: true,
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+	assert.Len(t, hook.pool, 1)
+
+	// the first entry reuses the test connection
+	newTestLogger(hook).Info("warm")
+	assert.Equal(t, "warm", nextPayload(t, s)["msg"])
+	assert.Equal(t, 1, s.Accepted())
+}
+
+func TestFireReturnsWriteError(t *testing.T) {
+	client, server := net.Pipe()
+	require.NoError(t, server.Close())
+	var reported []error
+	hook, err := NewWithConn("00000000-0000-0000-0000-000000000000", client, &Opts{
+		Priority: logrus.DebugLevel,
+		OnError:  func(err error) { reported = append(reported, err) },
+	})
+	require.NoError(t, err)
+
+	err = hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "lost"})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	// the diagnostic is still reported
+	require.Len(t, reported, 1)
+	assert.ErrorIs(t, reported[0], io.ErrClosedPipe)
+
+	// entries dropped on purpose aren't failures
+	assert.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.TraceLevel, Message: "filtered"}))
+}
+
+func TestFormatIsDeterministic(t *testing.T) {
+	entry := &logrus.Entry{
+		Time:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:   logrus.InfoLevel,
+		Message: "same every time",
+		Data: logrus.Fields{
+			"zeta":  1,
+			"alpha": map[string]interface{}{"y": 1, "b": 2, "m": map[string]int{"q": 1, "c": 2}},
+			"mid":   []byte("bytes"),
+			"err":   errors.New("boom"),
+		},
+	}
+
+	for name, options := range map[string]*Opts{
+		"json":   {},
+		"nested": {NestFieldsUnder: "fields", ByteSliceEncoding: ByteSliceHex},
+		"gelf":   {GELF: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			hook := newHook("token")
+			require.NoError(t, hook.applyOptions(options))
+
+			first, err := hook.format(entry)
+			require.NoError(t, err)
+			for i := 0; i < 50; i++ {
+				line, err := hook.format(entry)
+				require.NoError(t, err)
+				require.Equal(t, first, line)
+			}
+		})
+	}
+}
+
+func TestEmptyTokenWithDatahub(t *testing.T) {
+	s := newLineServerAt(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(datahubTestPort)), nil)
+	datahub := func() *UnencryptedConnectionConfig {
+		return &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1", Port: datahubTestPort}
+	}
+
+	hook, err := New("", "eu", &Opts{Priority: logrus.DebugLevel, DatahubConfig: datahub()})
+	require.NoError(t, err)
+	t.Cleanup(hook.FlushAndClose)
+	newTestLogger(hook).Info("agent adds the token")
+	line := s.nextLine(t)
+	assert.True(t, strings.HasPrefix(line, `{"level":"info"`), line)
+
+	_, err = New("", "eu", &Opts{DatahubConfig: datahub(), SendToken: true})
+	assert.Error(t, err)
+	_, err = New("", "eu", &Opts{})
+	assert.Error(t, err)
+	_, err = New("", "eu", nil)
+	assert.Error(t, err)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// accepts connections but never reads them, so writes stall once the socket buffers fill
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	hook := newHook("token ")
+	hook.network, hook.host, hook.port = "tcp", "127.0.0.1", l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, hook.applyOptions(&Opts{WriteTimeout: 100 * time.Millisecond}))
+	defer hook.FlushAndClose()
+
+	start := time.Now()
+	err = hook.write(strings.Repeat("x", 64<<20) + "\n")
+	require.Error(t, err)
+	assert.True(t, isTimeout(err), err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Empty(t, hook.pool, "a timed out connection is not reused")
+}
+
+func TestRegions(t *testing.T) {
+	for _, c := range []struct {
+		region string
+		host   string
+	}{
+		{"eu", "eu.data.logs.insight.rapid7.com"},
+		{"us", "us.data.logs.insight.rapid7.com"},
+		{"au", "au.data.logs.insight.rapid7.com"},
+		{"ca", "ca.data.logs.insight.rapid7.com"},
+		{"ap", "ap.data.logs.insight.rapid7.com"},
+		{"jp", "jp.data.logs.insight.rapid7.com"},
+	} {
+		t.Run(c.region, func(t *testing.T) {
+			// pinned to loopback so the test connection doesn't leave the machine
+			hook, err := New("00000000-0000-0000-0000-000000000000", c.region, &Opts{StaticHosts: map[string]string{c.host: "127.0.0.1"}})
+			require.NoError(t, err)
+			t.Cleanup(hook.FlushAndClose)
+			assert.Equal(t, c.host, hook.host)
+			assert.Equal(t, tlsPort, hook.port)
+		})
+	}
+
+	for _, region := range []string{"", "EU", "uk", "eu-west-1"} {
+		_, err := New("00000000-0000-0000-0000-000000000000", region, nil)
+		require.Error(t, err, region)
+		assert.Contains(t, err.Error(), "eu, us, au, ca, ap, jp")
+	}
+}
+
+func TestFireCtxCancellation(t *testing.T) {
+	// accepts connections but never reads or answers them, so TLS handshakes and large writes stall
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	newStalledHook := func(encrypt bool) *InsightOpsHook {
+		hook := newHook("token ")
+		hook.encrypt = encrypt
+		hook.network, hook.host, hook.port = "tcp", "127.0.0.1", l.Addr().(*net.TCPAddr).Port
+		require.NoError(t, hook.applyOptions(&Opts{Priority: logrus.DebugLevel, WriteTimeout: -1, OnError: func(error) {}}))
+		t.Cleanup(hook.FlushAndClose)
+		return hook
+	}
+	fireCancelled := func(hook *InsightOpsHook, message string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		err := hook.FireCtx(ctx, &logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: message})
+		assert.Less(t, time.Since(start), 2*time.Second)
+		return err
+	}
+
+	t.Run("mid-dial", func(t *testing.T) {
+		assert.ErrorIs(t, fireCancelled(newStalledHook(true), "handshake never completes"), context.Canceled)
+	})
+	t.Run("mid-write", func(t *testing.T) {
+		assert.ErrorIs(t, fireCancelled(newStalledHook(false), strings.Repeat("x", 16<<20)), context.Canceled)
+	})
+}
+
+func TestTokenValidation(t *testing.T) {
+	// pinned to loopback so the test connection doesn't leave the machine
+	options := func() *Opts {
+		return &Opts{StaticHosts: map[string]string{"eu" + hostPostfix: "127.0.0.1"}}
+	}
+
+	for _, token := range []string{"00000000-0000-0000-0000-000000000000", "3F2504E0-4F89-41D3-9A0C-0305E82C3301"} {
+		hook, err := New(token, "eu", options())
+		require.NoError(t, err, token)
+		hook.FlushAndClose()
+	}
+
+	for _, token := range []string{"not-a-token", "3F2504E0-4F89-41D3-9A0C-0305E82C330", "3F2504E0_4F89_41D3_9A0C_0305E82C3301", "g0000000-0000-0000-0000-000000000000"} {
+		_, err := New(token, "eu", options())
+		require.Error(t, err, token)
+		assert.NotContains(t, err.Error(), token, "the token isn't echoed")
+	}
+
+	skip := options()
+	skip.SkipTokenValidation = true
+	hook, err := New("datahub-specific", "eu", skip)
+	require.NoError(t, err)
+	hook.FlushAndClose()
+}
+
+func TestConfigErrors(t *testing.T) {
+	const token = "00000000-0000-0000-0000-000000000000"
+	for _, c := range []struct {
+		name     string
+		token    string
+		region   string
+		options  *Opts
+		sentinel error
+		field    string
+		message  string
+	}{
+		{"missing token", "", "eu", nil, ErrTokenRequired, "Token", "a Token is required"},
+		{"invalid token", "not-a-token", "eu", nil, ErrInvalidToken, "Token", "must be a UUID"},
+		{"invalid region", token, "mars", nil, ErrInvalidRegion, "Region", "a Region is required"},
+		{"datahub without host", token, "eu", &Opts{DatahubConfig: &UnencryptedConnectionConfig{}}, ErrDatahubHostRequired, "DatahubConfig.Host", "must contain a Host target"},
+		{"invalid proxy protocol", token, "eu", &Opts{ProxyProtocol: "v3"}, ErrInvalidOption, "ProxyProtocol", "ProxyProtocol must be v1 or v2"},
+		{"pool too large", token, "eu", &Opts{PoolSize: maxPoolSize + 1}, ErrInvalidOption, "PoolSize", "exceeds the maximum"},
+		{"GELF and Formatter", token, "eu", &Opts{GELF: true, Formatter: &logrus.TextFormatter{}}, ErrInvalidOption, "Formatter", "can't both be set"},
+		{"field clash", token, "eu", &Opts{AddRegionField: true, RegionField: "msg"}, ErrInvalidOption, "RegionField", "both use the field"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := New(c.token, c.region, c.options)
+			assert.ErrorIs(t, err, c.sentinel)
+			var configErr *ConfigError
+			require.ErrorAs(t, err, &configErr)
+			assert.Equal(t, c.field, configErr.Field)
+			assert.ErrorContains(t, err, "unable to create new hook: ")
+			assert.ErrorContains(t, err, c.message)
+		})
+	}
+
+	_, err := NewWithConn(token, nil, nil)
+	assert.ErrorIs(t, err, ErrConnRequired)
+}
+
+func TestNewFromEnv(t *testing.T) {
+	options := &Opts{StaticHosts: map[string]string{"eu" + hostPostfix: "127.0.0.1"}}
+
+	t.Setenv(TokenEnv, "")
+	_, err := NewFromEnv("eu", options)
+	assert.ErrorContains(t, err, "a Token is required")
+
+	t.Setenv(TokenEnv, "not-a-token")
+	_, err = NewFromEnv("eu", options)
+	assert.ErrorContains(t, err, "must be a UUID")
+
+	t.Setenv(TokenEnv, "00000000-0000-0000-0000-000000000000")
+	hook, err := NewFromEnv("eu", options)
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+	assert.Equal(t, "00000000-0000-0000-0000-000000000000", hook.token)
+}
+
+func TestTLSPinningAndMinVersion(t *testing.T) {
+	host := "eu" + hostPostfix
+	cert, roots := newTestCertificate(t, host)
+	other, _ := newTestCertificate(t, host)
+
+	newTLSHook := func(t *testing.T, serverConfig *tls.Config, options *Opts) *InsightOpsHook {
+		s := newLineServer(t, serverConfig)
+		options.TlsConfig = &tls.Config{RootCAs: roots}
+		options.StaticHosts = map[string]string{host: "127.0.0.1"}
+		hook, err := New("00000000-0000-0000-0000-000000000000", "eu", options)
+		require.NoError(t, err)
+		t.Cleanup(hook.FlushAndClose)
+		hook.port = s.Port()
+		return hook
+	}
+	server := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	t.Run("pin matches", func(t *testing.T) {
+		hook := newTLSHook(t, server, &Opts{PinnedCertSHA256: [][32]byte{sha256.Sum256(other.Leaf.Raw), sha256.Sum256(cert.Leaf.Raw)}})
+		conn, err := hook.netConnect()
+		require.NoError(t, err)
+		_ = conn.Close()
+	})
+	t.Run("pin mismatch", func(t *testing.T) {
+		hook := newTLSHook(t, server, &Opts{PinnedCertSHA256: [][32]byte{sha256.Sum256(other.Leaf.Raw)}})
+		_, err := hook.netConnect()
+		assert.ErrorIs(t, err, ErrCertificatePinMismatch)
+	})
+	t.Run("minimum version", func(t *testing.T) {
+		legacy := &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS11}
+		_, err := newTLSHook(t, legacy, &Opts{}).netConnect()
+		assert.Error(t, err, "TLS 1.2 is required by default")
+
+		modern := &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}
+		_, err = newTLSHook(t, modern, &Opts{MinTLSVersion: tls.VersionTLS13}).netConnect()
+		assert.Error(t, err)
+	})
+}
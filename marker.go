@@ -0,0 +1,43 @@
+package insightops_logrus
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+const startupMarkerMessage = "logger_started"
+
+// emitStartupMarker writes a "logger_started" entry describing this process instance, so InsightOps shows when its
+// logging came online. Like SelfTest it bypasses the hook's level range and required-field checks.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) emitStartupMarker() error {
+	fields := logrus.Fields{"pid": os.Getpid()}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		fields["hostname"] = name
+	}
+	if hook.region != "" {
+		fields["region"] = hook.region
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		fields["version"] = info.Main.Version
+	}
+
+	line, err := hook.format(&logrus.Entry{
+		Data:    fields,
+		Time:    time.Now(),
+		Level:   logrus.InfoLevel,
+		Message: startupMarkerMessage,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to format startup marker: %w", err)
+	}
+	if err = hook.writeLine(context.Background(), line, time.Time{}); err != nil {
+		return fmt.Errorf("unable to write startup marker: %w", err)
+	}
+	return nil
+}
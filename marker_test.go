@@ -0,0 +1,31 @@
+package insightops_logrus
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestEmitStartupMarker(t *testing.T) {
+	s := newLineServerAt(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(datahubTestPort)), nil)
+	hook, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{
+		Priority:          logrus.DebugLevel,
+		DatahubConfig:     &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1", Port: datahubTestPort},
+		EmitStartupMarker: true,
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+	newTestLogger(hook).Info("after start")
+
+	marker := nextPayload(t, s)
+	assert.Equal(t, startupMarkerMessage, marker["msg"])
+	assert.Equal(t, "eu", marker["region"])
+	assert.Equal(t, float64(os.Getpid()), marker["pid"])
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, marker["hostname"])
+	assert.Equal(t, "after start", nextPayload(t, s)["msg"])
+}
@@ -0,0 +1,49 @@
+package insightops_logrus
+
+import (
+	"runtime"
+	"time"
+)
+
+// memPressureInterval is how often FlushOnMemPressure reads the heap size. runtime.ReadMemStats briefly stops the
+// world, so it isn't read more often than this.
+const memPressureInterval = time.Second
+
+// heapAllocProvider returns the bytes of allocated heap objects. Swappable for tests.
+var heapAllocProvider = func() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// startMemPressureCheck starts the background goroutine writing the current batch early whenever the heap is above
+// threshold, and exits once FlushAndClose is called
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) startMemPressureCheck(threshold uint64) {
+	hook.memPressureStop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(memPressureInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hook.memPressureStop:
+				return
+			case <-ticker.C:
+				hook.checkMemPressure(threshold)
+			}
+		}
+	}()
+}
+
+// checkMemPressure writes the current batch, if any, when the heap is above threshold, reporting whether it did
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) checkMemPressure(threshold uint64) bool {
+	if heapAllocProvider() <= threshold {
+		return false
+	}
+	hook.flushBatchInBackground(flushedByMemPressure)
+	return true
+}
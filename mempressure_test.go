@@ -0,0 +1,67 @@
+package insightops_logrus
+
+import (
+	"bufio"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlushOnMemPressure(t *testing.T) {
+	var heap atomic.Uint64
+	original := heapAllocProvider
+	t.Cleanup(func() { heapAllocProvider = original })
+	heapAllocProvider = func() uint64 { return heap.Load() }
+
+	client, server := net.Pipe()
+	defer server.Close()
+	lines := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	hook, err := NewWithConn("token ", client, &Opts{
+		Priority:             logrus.DebugLevel,
+		BatchSize:            10,
+		BatchFlushInterval:   time.Hour,
+		FlushOnMemPressure:   true,
+		MemPressureHeapBytes: 1 << 20,
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+
+	for _, msg := range []string{"one", "two"} {
+		require.NoError(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: msg}))
+	}
+	heap.Store(1 << 19)
+	assert.False(t, hook.checkMemPressure(1<<20))
+	assert.Len(t, hook.batch, 2, "the batch is held below the threshold")
+
+	heap.Store(2 << 20)
+	assert.True(t, hook.checkMemPressure(1<<20))
+	for _, msg := range []string{"one", "two"} {
+		select {
+		case line := <-lines:
+			assert.Contains(t, line, `"msg":"`+msg+`"`)
+		case <-time.After(time.Second):
+			t.Fatal("the batch wasn't flushed above the threshold")
+		}
+	}
+	assert.Equal(t, uint64(2), hook.Stats().Sent)
+	assert.Equal(t, uint64(1), hook.Stats().BatchFlushesByMemPressure)
+}
+
+func TestFlushOnMemPressureOptions(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	_, err := NewWithConn("token ", client, &Opts{FlushOnMemPressure: true, MemPressureHeapBytes: 1 << 20})
+	assert.ErrorContains(t, err, "FlushOnMemPressure")
+	_, err = NewWithConn("token ", client, &Opts{BatchSize: 10, FlushOnMemPressure: true})
+	assert.ErrorContains(t, err, "MemPressureHeapBytes")
+}
@@ -0,0 +1,223 @@
+package insightops_logrus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHookClosed is returned by writes once FlushAndClose has been called
+var ErrHookClosed = errors.New("insightops: hook is closed")
+
+const (
+	defaultPoolSize = 3
+	maxPoolSize     = 256
+
+	defaultFlushTimeout = 10 * time.Second
+
+	// prewarmDialAttempts bounds the attempts prewarm makes at each connection before giving up on the pool
+	prewarmDialAttempts = 3
+
+	// connProbeTimeout bounds connAlive's read. It can't be zero, as a read past its deadline fails without ever
+	// checking the socket.
+	connProbeTimeout = time.Millisecond
+)
+
+// idleConn is a pooled connection and when it was last used
+type idleConn struct {
+	net.Conn
+	lastUsed time.Time
+}
+
+// getConn returns an idle connection from the pool, or dials a new one (bounded by deadline, if not zero) when the
+// pool is empty. pooled reports which, as a pooled connection may have been closed by the other end while idle.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) getConn(ctx context.Context, deadline time.Time) (conn net.Conn, pooled bool, err error) {
+	if hook.isClosed() {
+		return nil, false, ErrHookClosed
+	}
+
+	for {
+		select {
+		case idle, ok := <-hook.pool:
+			if !ok {
+				// closed since the check above
+				return nil, false, ErrHookClosed
+			}
+			conn = idle.Conn
+			if hook.idleExpired(idle) || hook.validateConnOnBorrow && !connAlive(conn) {
+				_ = conn.Close()
+				continue
+			}
+			if !deadline.IsZero() {
+				_ = conn.SetDeadline(deadline)
+			}
+			return conn, true, nil
+		default:
+			conn, err = hook.connect(ctx, deadline)
+			return conn, false, err
+		}
+	}
+}
+
+// connAlive probes an idle connection with a read that barely blocks: a timeout means the connection is still open,
+// while EOF or any other error means the other end has gone away
+func connAlive(conn net.Conn) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(connProbeTimeout))
+	_, err := conn.Read(make([]byte, 1))
+	_ = conn.SetReadDeadline(time.Time{})
+	return err == nil || isTimeout(err)
+}
+
+// putConn returns a healthy connection to the pool, closing it instead when the pool is full or the hook is closed
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) putConn(conn net.Conn) {
+	hook.returnConn(conn, hook.poolGeneration.Load())
+}
+
+// returnConn is putConn for a connection borrowed while the pool was at generation, which is closed instead if
+// ReResolveInterval has recycled the pool since
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) returnConn(conn net.Conn, generation uint64) {
+	hook.poolMutex.Lock()
+	defer hook.poolMutex.Unlock()
+
+	if hook.closed || hook.poolGeneration.Load() != generation {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	select {
+	case hook.pool <- idleConn{conn, time.Now()}:
+	default:
+		_ = conn.Close()
+	}
+}
+
+// prewarm fills the pool with freshly dialed connections, dialing up to Opts.PrewarmConcurrency at a time. A failed
+// dial is retried up to prewarmDialAttempts times; if it still fails, no more dials are started, the connections
+// already opened are closed and the pool is left empty.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) prewarm() error {
+	conns := make([]net.Conn, hook.poolSize)
+	errs := make([]error, hook.poolSize)
+	slots := make(chan struct{}, max(hook.prewarmConcurrency, 1))
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for i := range conns {
+		slots <- struct{}{}
+		if failed.Load() {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if conns[i], errs[i] = hook.prewarmDial(); errs[i] != nil {
+				failed.Store(true)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if failed.Load() {
+		for _, conn := range conns {
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}
+		return errors.Join(errs...)
+	}
+	for _, conn := range conns {
+		hook.putConn(conn)
+	}
+	return nil
+}
+
+// prewarmDial dials one of prewarm's connections, making up to prewarmDialAttempts attempts
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) prewarmDial() (conn net.Conn, err error) {
+	for attempt := 1; ; attempt++ {
+		if conn, err = hook.netConnect(); err == nil || attempt >= prewarmDialAttempts {
+			return conn, err
+		}
+	}
+}
+
+// isClosed reports whether FlushAndClose has been called
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) isClosed() bool {
+	hook.poolMutex.Lock()
+	defer hook.poolMutex.Unlock()
+	return hook.closed
+}
+
+// FlushAndClose is FlushAndCloseContext giving up on queued entries after 10 seconds, reporting any it drops
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) FlushAndClose() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultFlushTimeout)
+	defer cancel()
+	if dropped, err := hook.FlushAndCloseContext(ctx); err != nil {
+		hook.reportError(fmt.Errorf("%d queued entries dropped at shutdown: %w", dropped, err))
+	}
+}
+
+// FlushAndCloseContext delivers any entries queued by Opts.Async or batched by Opts.BatchSize, then closes all pooled
+// connections. Writes made afterwards, including ones racing with it, fail with ErrHookClosed. Calling it again does
+// nothing.
+// If ctx is done before the queue is delivered, the remaining entries are dropped and counted in Stats, and their
+// number is returned with ctx's error. The final batch is written within ctx too; if that write fails, its entries
+// are added to the number returned along with the error.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) FlushAndCloseContext(ctx context.Context) (dropped int, err error) {
+	dropped, err = hook.closeQueue(ctx)
+	hook.closeBatch()
+	deadline, _ := ctx.Deadline()
+	if failed, batchErr := hook.flushBatch(ctx, deadline, flushedByShutdown); batchErr != nil {
+		dropped += failed
+		if err == nil {
+			err = batchErr
+		}
+	}
+
+	hook.poolMutex.Lock()
+	defer hook.poolMutex.Unlock()
+
+	if hook.closed {
+		return
+	}
+	hook.closed = true
+	if hook.reaperStop != nil {
+		close(hook.reaperStop)
+	}
+	if hook.resolverStop != nil {
+		close(hook.resolverStop)
+	}
+	if hook.memPressureStop != nil {
+		close(hook.memPressureStop)
+	}
+	close(hook.pool)
+	for conn := range hook.pool {
+		_ = conn.Close()
+	}
+	if hook.httpClient != nil {
+		hook.httpClient.CloseIdleConnections()
+	}
+	if hook.destination != "" {
+		unregisterDestination(hook.destination)
+	}
+	return
+}
@@ -0,0 +1,445 @@
+package insightops_logrus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrewarmPool(t *testing.T) {
+	s := newLineServerAt(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(datahubTestPort)), nil)
+	hook, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{
+		Priority:           logrus.DebugLevel,
+		DatahubConfig:      &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1", Port: datahubTestPort},
+		PrewarmPool:        true,
+		FailOnConnectError: true,
+	})
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+
+	assert.Len(t, hook.pool, hook.poolSize)
+	require.Eventually(t, func() bool { return s.Accepted() == hook.poolSize }, time.Second, 10*time.Millisecond)
+
+	// writes use the prewarmed connections rather than dialing
+	logger := newTestLogger(hook)
+	for i := 0; i < hook.poolSize; i++ {
+		logger.Info("warm")
+		assert.Equal(t, "warm", nextPayload(t, s)["msg"])
+	}
+	assert.Equal(t, hook.poolSize, s.Accepted())
+}
+
+func TestPrewarmPoolRollsBackOnFailure(t *testing.T) {
+	SetMaxTotalConnections(2)
+	t.Cleanup(func() { SetMaxTotalConnections(0) })
+
+	s := newLineServerAt(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(datahubTestPort)), nil)
+	_, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{
+		DatahubConfig:      &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1", Port: datahubTestPort},
+		PrewarmPool:        true,
+		FailOnConnectError: true,
+	})
+	assert.ErrorIs(t, err, ErrTooManyConnections)
+
+	// the two connections that did open were closed, freeing their slots
+	hook := newTestHook(t, s, nil)
+	for i := 0; i < 2; i++ {
+		conn, err := hook.netConnect()
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+}
+
+// concurrencyDialer hands out in-memory connections after a short wait, tracking the most dials in flight at once,
+// and fails the first failures dials
+type concurrencyDialer struct {
+	mu       sync.Mutex
+	dials    int
+	inFlight int
+	peak     int
+	failures int
+}
+
+func (d *concurrencyDialer) dial(ctx context.Context, deadline time.Time) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials++
+	if d.failures > 0 {
+		d.failures--
+		d.mu.Unlock()
+		return nil, errors.New("refused")
+	}
+	d.inFlight++
+	d.peak = max(d.peak, d.inFlight)
+	d.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+	d.mu.Lock()
+	d.inFlight--
+	d.mu.Unlock()
+	client, _ := net.Pipe()
+	return client, nil
+}
+
+func TestPrewarmConcurrency(t *testing.T) {
+	dialer := &concurrencyDialer{failures: 2}
+	hook := newHook("token ")
+	hook.connDialer = dialer
+	require.NoError(t, hook.applyOptions(&Opts{PoolSize: 8, PrewarmConcurrency: 3}))
+	defer hook.FlushAndClose()
+
+	require.NoError(t, hook.prewarm())
+	assert.Len(t, hook.pool, 8, "failed dials are retried")
+	assert.Equal(t, 10, dialer.dials)
+	assert.Equal(t, 3, dialer.peak, "no more than PrewarmConcurrency dials are in flight")
+
+	// a dial failing every attempt leaves the pool empty
+	dialer = &concurrencyDialer{failures: prewarmDialAttempts}
+	hook = newHook("token ")
+	hook.connDialer = dialer
+	require.NoError(t, hook.applyOptions(&Opts{PoolSize: 4}))
+	defer hook.FlushAndClose()
+	assert.Error(t, hook.prewarm())
+	assert.Empty(t, hook.pool)
+	assert.Equal(t, prewarmDialAttempts, dialer.dials, "dialing one at a time, none are started after the failure")
+}
+
+func TestPoolSize(t *testing.T) {
+	s := newLineServer(t, nil)
+
+	hook := newTestHook(t, s, nil)
+	assert.Equal(t, defaultPoolSize, hook.poolSize)
+	assert.Equal(t, defaultPoolSize, cap(hook.pool))
+
+	hook = newTestHook(t, s, &Opts{PoolSize: 10})
+	assert.Equal(t, 10, hook.poolSize)
+	assert.Equal(t, 10, cap(hook.pool))
+
+	hook = newTestHook(t, s, &Opts{PoolSize: -1})
+	assert.Equal(t, defaultPoolSize, hook.poolSize)
+
+	_, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{PoolSize: maxPoolSize + 1})
+	assert.ErrorContains(t, err, "PoolSize")
+}
+
+func TestNoPooling(t *testing.T) {
+	s := newLineServer(t, nil)
+	dialer := &countingDialer{address: s.listener.Addr().String()}
+	hook := newHook("token ")
+	hook.connDialer = dialer
+	require.NoError(t, hook.applyOptions(&Opts{Priority: logrus.DebugLevel, NoPooling: true, OnError: func(error) {}}))
+	defer hook.FlushAndClose()
+	logger := newTestLogger(hook)
+
+	for _, msg := range []string{"one", "two", "three"} {
+		logger.Info(msg)
+		assert.Contains(t, <-s.lines, `"msg":"`+msg+`"`)
+	}
+	assert.Equal(t, int32(3), dialer.dials.Load(), "each write dials its own connection")
+	assert.Equal(t, int32(3), dialer.closes.Load(), "each connection is closed after its write")
+	assert.Empty(t, hook.pool)
+
+	_, err := New("00000000-0000-0000-0000-000000000000", "eu", &Opts{NoPooling: true, PrewarmPool: true})
+	assert.ErrorContains(t, err, "PrewarmPool")
+}
+
+func TestWriteRetriesDeadPooledConnection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	lines := make(chan string, 2)
+	closed := make(chan struct{})
+	go func() {
+		// the first connection reads one line then is reset, as an idle timeout on the server would
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		_ = conn.Close()
+		close(closed)
+
+		if conn, err = l.Accept(); err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ = bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}()
+
+	hook := newHook("token ")
+	hook.network, hook.host, hook.port = "tcp", "127.0.0.1", l.Addr().(*net.TCPAddr).Port
+	defer hook.FlushAndClose()
+
+	require.NoError(t, hook.write("first\n"))
+	assert.Equal(t, "token first\n", <-lines)
+	<-closed
+	// let the reset reach the client so the pooled connection is known dead
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, hook.write("second\n"))
+	select {
+	case line := <-lines:
+		assert.Equal(t, "token second\n", line)
+	case <-time.After(time.Second):
+		t.Fatal("second line was not delivered through a new connection")
+	}
+}
+
+func TestWriteDoesntRetryOnceContextDone(t *testing.T) {
+	dialer := newPipeDialer()
+	hook := newHook("token ")
+	hook.connDialer = dialer
+	require.NoError(t, hook.applyOptions(&Opts{Priority: logrus.DebugLevel, OnError: func(error) {}}))
+	defer hook.FlushAndClose()
+
+	// nothing reads from the pooled connection, so the write hangs until ctx cuts it short
+	client, server := net.Pipe()
+	defer server.Close()
+	hook.putConn(client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := hook.writeLine(ctx, "line\n", time.Time{})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, dialer.dials, "a cancelled write isn't retried on a new connection")
+}
+
+func TestWriteTimeoutPolicy(t *testing.T) {
+	for name, policy := range map[string]WriteTimeoutPolicy{"fail": WriteTimeoutFail, "retry": WriteTimeoutRetry, "drop": WriteTimeoutDrop} {
+		t.Run(name, func(t *testing.T) {
+			dialer := newPipeDialer()
+			var fallback bytes.Buffer
+			hook := newHook("token ")
+			hook.connDialer = dialer
+			require.NoError(t, hook.applyOptions(&Opts{
+				Priority:           logrus.DebugLevel,
+				WriteTimeout:       50 * time.Millisecond,
+				WriteTimeoutPolicy: policy,
+				Fallback:           &fallback,
+				OnError:            func(error) {},
+			}))
+			defer hook.FlushAndClose()
+
+			// nothing reads from the pooled connection, so the write times out
+			client, server := net.Pipe()
+			defer server.Close()
+			hook.putConn(client)
+
+			err := hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "one"})
+			switch policy {
+			case WriteTimeoutFail:
+				assert.NoError(t, err)
+				assert.Contains(t, fallback.String(), `"msg":"one"`)
+				assert.Equal(t, uint64(1), hook.Stats().FellBack)
+				assert.Zero(t, dialer.dials)
+			case WriteTimeoutRetry:
+				assert.NoError(t, err)
+				assert.Contains(t, <-dialer.lines, `"msg":"one"`)
+				assert.Equal(t, uint64(1), hook.Stats().Reconnects)
+				assert.Empty(t, fallback.String())
+			case WriteTimeoutDrop:
+				assert.True(t, isTimeout(err), err)
+				assert.Empty(t, fallback.String())
+				assert.Equal(t, uint64(1), hook.Stats().Failed)
+				assert.Zero(t, dialer.dials)
+			}
+		})
+	}
+}
+
+func TestFireRacingFlushAndClose(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, OnError: func(error) {}})
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 20; j++ {
+				err := hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "racing"})
+				if err != nil {
+					assert.ErrorIs(t, err, ErrHookClosed)
+				}
+			}
+		}()
+	}
+	close(start)
+	assert.NotPanics(t, hook.FlushAndClose)
+	wg.Wait()
+
+	assert.ErrorIs(t, hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "late"}), ErrHookClosed)
+	assert.Empty(t, hook.pool)
+	assert.NotPanics(t, hook.FlushAndClose)
+}
+
+func TestValidateConnOnBorrow(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, ValidateConnOnBorrow: true})
+	logger := newTestLogger(hook)
+
+	logger.Info("one")
+	assert.Equal(t, "one", nextPayload(t, s)["msg"])
+	require.Len(t, hook.pool, 1)
+
+	// the server drops the pooled connection while it's idle
+	s.ResetConns()
+	time.Sleep(50 * time.Millisecond)
+
+	// the probe catches it before the write, so the write-retry path isn't needed
+	logger.Info("two")
+	assert.Equal(t, "two", nextPayload(t, s)["msg"])
+	assert.Equal(t, 2, s.Accepted())
+	assert.Zero(t, hook.Stats().Reconnects)
+
+	// a live connection passes the probe and is reused
+	logger.Info("three")
+	assert.Equal(t, "three", nextPayload(t, s)["msg"])
+	assert.Equal(t, 2, s.Accepted())
+}
+
+// pipeDialer hands out in-memory connections, whose other ends are read into lines, and fails while err is set
+type pipeDialer struct {
+	mu     sync.Mutex
+	err    error
+	dials  int
+	lines  chan string
+	remote []net.Conn
+}
+
+func newPipeDialer() *pipeDialer {
+	return &pipeDialer{lines: make(chan string, 100)}
+}
+
+func (d *pipeDialer) dial(ctx context.Context, deadline time.Time) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.err != nil {
+		return nil, d.err
+	}
+	client, server := net.Pipe()
+	d.remote = append(d.remote, server)
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			d.lines <- scanner.Text()
+		}
+	}()
+	return client, nil
+}
+
+// closeRemote closes the other end of every connection handed out so far
+func (d *pipeDialer) closeRemote() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, conn := range d.remote {
+		_ = conn.Close()
+	}
+	d.remote = nil
+}
+
+func TestFireThroughConnDialer(t *testing.T) {
+	dialer := newPipeDialer()
+	hook := newHook("token ")
+	hook.connDialer = dialer
+	require.NoError(t, hook.applyOptions(&Opts{Priority: logrus.DebugLevel, OnError: func(error) {}}))
+	defer hook.FlushAndClose()
+	logger := newTestLogger(hook)
+
+	logger.Info("one")
+	line := <-dialer.lines
+	assert.True(t, strings.HasPrefix(line, "token {"), line)
+	assert.Contains(t, line, `"msg":"one"`)
+
+	// a dead pooled connection is replaced through the dialer
+	dialer.closeRemote()
+	require.NoError(t, hook.write("two\n"))
+	assert.Equal(t, "token two", <-dialer.lines)
+	assert.Equal(t, uint64(1), hook.Stats().Reconnects)
+	assert.Equal(t, 2, dialer.dials)
+
+	// dial failures surface from Fire
+	dialer.closeRemote()
+	drainPool(hook)
+	dialer.err = errors.New("network unreachable")
+	err := hook.Fire(&logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "three"})
+	assert.ErrorIs(t, err, dialer.err)
+	assert.Equal(t, uint64(1), hook.Stats().Failed)
+}
+
+func TestIdleReaper(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, IdleTimeout: 50 * time.Millisecond, PoolSize: 2})
+	logger := newTestLogger(hook)
+
+	// two writes at once leave two connections in the pool
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Info("concurrent")
+		}()
+	}
+	wg.Wait()
+	nextPayload(t, s)
+	nextPayload(t, s)
+	accepted := s.Accepted()
+	require.NotZero(t, len(hook.pool))
+
+	// the reaper closes them once they've been idle too long
+	require.Eventually(t, func() bool { return len(hook.pool) == 0 }, time.Second, 5*time.Millisecond)
+	logger.Info("fresh")
+	assert.Equal(t, "fresh", nextPayload(t, s)["msg"])
+	assert.Equal(t, accepted+1, s.Accepted())
+
+	// and stops with the hook
+	hook.FlushAndClose()
+	select {
+	case <-hook.reaperStop:
+	default:
+		t.Fatal("the reaper was not stopped")
+	}
+}
+
+func TestIdleReaperTinyTimeout(t *testing.T) {
+	s := newLineServer(t, nil)
+	// a timeout too small to halve into a ticker interval mustn't crash the reaper
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, IdleTimeout: 1})
+
+	newTestLogger(hook).Info("one")
+	assert.Equal(t, "one", nextPayload(t, s)["msg"])
+	require.Eventually(t, func() bool { return len(hook.pool) == 0 }, time.Second, 5*time.Millisecond)
+}
+
+func TestInvalidOptionsStartNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		_, err := NewWithConn("token ", &net.TCPConn{}, &Opts{
+			IdleTimeout: time.Minute,
+			Async:       true,
+			GELF:        true,
+			Formatter:   &logrus.TextFormatter{},
+		})
+		require.ErrorIs(t, err, ErrInvalidOption)
+	}
+	// allow for goroutines of earlier tests winding down, but not one per failed hook
+	assert.Less(t, runtime.NumGoroutine(), before+20)
+}
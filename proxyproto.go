@@ -0,0 +1,68 @@
+package insightops_logrus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// writeProxyHeader writes a PROXY protocol header describing conn's local (source) and remote (destination) addresses
+func writeProxyHeader(conn net.Conn, version string) error {
+	local, lok := conn.LocalAddr().(*net.TCPAddr)
+	remote, rok := conn.RemoteAddr().(*net.TCPAddr)
+	if !lok || !rok {
+		return fmt.Errorf("proxy protocol requires a tcp connection")
+	}
+
+	var header []byte
+	switch version {
+	case proxyProtocolV1:
+		header = proxyHeaderV1(local, remote)
+	case proxyProtocolV2:
+		header = proxyHeaderV2(local, remote)
+	default:
+		return fmt.Errorf("unsupported proxy protocol version %q", version)
+	}
+	_, err := conn.Write(header)
+	return err
+}
+
+// proxyHeaderV1 builds the human-readable v1 header, e.g. "PROXY TCP4 10.0.0.1 10.0.0.2 51234 443\r\n"
+func proxyHeaderV1(local, remote *net.TCPAddr) []byte {
+	family := "TCP6"
+	if local.IP.To4() != nil && remote.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, local.IP, remote.IP, local.Port, remote.Port))
+}
+
+// proxyHeaderV2 builds the binary v2 header for a proxied tcp stream
+func proxyHeaderV2(local, remote *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(0x21) // version 2, PROXY command
+
+	if src, dst := local.IP.To4(), remote.IP.To4(); src != nil && dst != nil {
+		buf.WriteByte(0x11) // AF_INET, STREAM
+		_ = binary.Write(&buf, binary.BigEndian, uint16(12))
+		buf.Write(src)
+		buf.Write(dst)
+	} else {
+		buf.WriteByte(0x21) // AF_INET6, STREAM
+		_ = binary.Write(&buf, binary.BigEndian, uint16(36))
+		buf.Write(local.IP.To16())
+		buf.Write(remote.IP.To16())
+	}
+	_ = binary.Write(&buf, binary.BigEndian, uint16(local.Port))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(remote.Port))
+	return buf.Bytes()
+}
@@ -0,0 +1,110 @@
+package insightops_logrus
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitPolicy selects what happens to entries fired faster than Opts.MaxLinesPerSecond allows
+type RateLimitPolicy int
+
+const (
+	RateLimitDrop  RateLimitPolicy = iota // the entry is dropped and counted in Stats
+	RateLimitBlock                        // Fire waits until the entry is within the limit
+)
+
+// rateLimiter is a token bucket holding up to burst tokens, refilled at rate tokens per second
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time // swapped out by tests
+}
+
+func newRateLimiter(perSecond int, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = perSecond
+	}
+	return &rateLimiter{
+		rate:   float64(perSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// refill adds the tokens accrued since the last call, up to burst. It must be called with mu held.
+func (l *rateLimiter) refill() {
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+}
+
+// allow takes a token if one is available
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// peek reports whether allow would currently succeed, without taking a token
+func (l *rateLimiter) peek() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	return l.tokens >= 1
+}
+
+// reserve takes a token, going into debt if none is available, and returns how long to wait before it's due
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel hands back a token taken by reserve that won't be used
+func (l *rateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+1)
+}
+
+// rateLimit applies Opts.RateLimitPolicy to an entry, reporting whether it may proceed. Blocking gives up when ctx is
+// done.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) rateLimit(ctx context.Context) bool {
+	if hook.rateLimitPolicy != RateLimitBlock {
+		return hook.rateLimiter.allow()
+	}
+
+	wait := hook.rateLimiter.reserve()
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		hook.rateLimiter.cancel()
+		return false
+	}
+}
@@ -0,0 +1,60 @@
+package insightops_logrus
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimitDrop(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, MaxLinesPerSecond: 10, BurstSize: 5})
+	now := time.Now()
+	hook.rateLimiter.now = func() time.Time { return now }
+	logger := newTestLogger(hook)
+
+	// a burst only lets BurstSize lines through
+	for i := 0; i < 20; i++ {
+		logger.Info("storm")
+	}
+	assert.Equal(t, uint64(5), hook.Stats().Sent)
+	assert.Equal(t, uint64(15), hook.Stats().DroppedRateLimit)
+
+	// then lines pass at MaxLinesPerSecond
+	now = now.Add(300 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		logger.Info("storm")
+	}
+	assert.Equal(t, uint64(8), hook.Stats().Sent)
+
+	// a quiet spell refills the bucket no further than BurstSize
+	now = now.Add(time.Minute)
+	for i := 0; i < 20; i++ {
+		logger.Info("storm")
+	}
+	assert.Equal(t, uint64(13), hook.Stats().Sent)
+	assert.Equal(t, uint64(47), hook.Stats().Dropped)
+}
+
+func TestRateLimitBlock(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, MaxLinesPerSecond: 100, BurstSize: 1, RateLimitPolicy: RateLimitBlock})
+	logger := newTestLogger(hook)
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		logger.Info("paced")
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, uint64(6), hook.Stats().Sent)
+	assert.Zero(t, hook.Stats().DroppedRateLimit)
+
+	// a wait cut short by the context drops the entry
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, hook.FireCtx(ctx, &logrus.Entry{Time: time.Now(), Level: logrus.InfoLevel, Message: "late"}))
+	assert.Equal(t, uint64(1), hook.Stats().DroppedRateLimit)
+	assert.Equal(t, uint64(6), hook.Stats().Sent)
+}
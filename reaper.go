@@ -0,0 +1,67 @@
+package insightops_logrus
+
+import (
+	"time"
+)
+
+// minReapInterval keeps tiny idle timeouts from spinning the reaper, or from making a zero interval NewTicker panics on
+const minReapInterval = 10 * time.Millisecond
+
+// startReaper starts the background goroutine closing pooled connections idle for longer than timeout. It checks
+// twice per timeout (at most every 10ms), so a connection is closed at most half a timeout late, and exits once
+// FlushAndClose is called.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) startReaper(timeout time.Duration) {
+	hook.reaperStop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(max(timeout/2, minReapInterval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hook.reaperStop:
+				return
+			case <-ticker.C:
+				hook.reapIdle()
+			}
+		}
+	}()
+}
+
+// reapIdle closes the pooled connections that have been idle for longer than Opts.IdleTimeout
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) reapIdle() {
+	// holding poolMutex keeps putConn from filling the room taken while the pool is sorted through, and
+	// FlushAndClose from closing it meanwhile
+	hook.poolMutex.Lock()
+	defer hook.poolMutex.Unlock()
+	if hook.closed {
+		return
+	}
+
+	var kept []idleConn
+	for n := len(hook.pool); n > 0; n-- {
+		select {
+		case idle := <-hook.pool:
+			if hook.idleExpired(idle) {
+				_ = idle.Close()
+			} else {
+				kept = append(kept, idle)
+			}
+		default:
+			// taken by getConn meanwhile
+		}
+	}
+	for _, idle := range kept {
+		hook.pool <- idle
+	}
+}
+
+// idleExpired reports whether a pooled connection has been idle for longer than Opts.IdleTimeout
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) idleExpired(idle idleConn) bool {
+	return hook.idleTimeout > 0 && time.Since(idle.lastUsed) > hook.idleTimeout
+}
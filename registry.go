@@ -0,0 +1,36 @@
+package insightops_logrus
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// destinations counts the hooks created per token and endpoint, to spot entries being shipped twice
+var destinations = struct {
+	sync.Mutex
+	hooks map[string]int
+}{hooks: map[string]int{}}
+
+// registerDestination records a hook shipping with token to the given endpoint, returning the key to unregister it by
+// and how many hooks (including this one) now do so
+func registerDestination(token string, network string, host string, port int) (key string, n int) {
+	key = fmt.Sprintf("%s|%s://%s", token, network, net.JoinHostPort(host, strconv.Itoa(port)))
+
+	destinations.Lock()
+	defer destinations.Unlock()
+	destinations.hooks[key]++
+	return key, destinations.hooks[key]
+}
+
+// unregisterDestination forgets a hook recorded by registerDestination, once it's closed
+func unregisterDestination(key string) {
+	destinations.Lock()
+	defer destinations.Unlock()
+	if destinations.hooks[key] <= 1 {
+		delete(destinations.hooks, key)
+		return
+	}
+	destinations.hooks[key]--
+}
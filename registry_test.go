@@ -0,0 +1,75 @@
+package insightops_logrus
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestWarnOnDuplicate(t *testing.T) {
+	var reported []error
+	options := func() *Opts {
+		return &Opts{
+			DatahubConfig:   &UnencryptedConnectionConfig{Type: "tcp", Host: "127.0.0.1", Port: 10000},
+			WarnOnDuplicate: true,
+			OnError:         func(err error) { reported = append(reported, err) },
+		}
+	}
+
+	first, err := New("11111111-1111-1111-1111-111111111111", "eu", options())
+	require.NoError(t, err)
+	defer first.FlushAndClose()
+	assert.Empty(t, reported)
+
+	// a different token is a different destination
+	other, err := New("22222222-2222-2222-2222-222222222222", "eu", options())
+	require.NoError(t, err)
+	defer other.FlushAndClose()
+	assert.Empty(t, reported)
+
+	second, err := New("11111111-1111-1111-1111-111111111111", "eu", options())
+	require.NoError(t, err)
+	require.Len(t, reported, 1)
+	assert.Contains(t, reported[0].Error(), "2 hooks ship with the same token to 127.0.0.1:10000")
+
+	// a hook closed (even twice) no longer counts, while the first one still does
+	second.FlushAndClose()
+	second.FlushAndClose()
+	third, err := New("11111111-1111-1111-1111-111111111111", "eu", options())
+	require.NoError(t, err)
+	require.Len(t, reported, 2)
+	assert.Contains(t, reported[1].Error(), "2 hooks ship")
+
+	// once both are closed, a replacement isn't reported
+	third.FlushAndClose()
+	first.FlushAndClose()
+	replacement, err := New("11111111-1111-1111-1111-111111111111", "eu", options())
+	require.NoError(t, err)
+	defer replacement.FlushAndClose()
+	assert.Len(t, reported, 2)
+}
+
+func TestFailedNewUnregistersDestination(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	var reported []error
+	options := &Opts{
+		EndpointHost:    "127.0.0.1",
+		EndpointPort:    port,
+		WarnOnDuplicate: true,
+		OnError:         func(err error) { reported = append(reported, err) },
+	}
+	failing := *options
+	failing.FailOnConnectError = true
+	_, err = New("33333333-3333-3333-3333-333333333333", "", &failing)
+	require.Error(t, err)
+
+	hook, err := New("33333333-3333-3333-3333-333333333333", "", options)
+	require.NoError(t, err)
+	defer hook.FlushAndClose()
+	assert.Empty(t, reported)
+}
@@ -0,0 +1,89 @@
+package insightops_logrus
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"time"
+)
+
+// startReResolver starts the background goroutine that looks the endpoint host up every interval, recycling the pool
+// when its addresses change so later writes dial the new ones. It exits once FlushAndClose is called.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) startReResolver(interval time.Duration) {
+	hook.resolverStop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		addrs := hook.reResolve(nil, interval)
+		for {
+			select {
+			case <-hook.resolverStop:
+				return
+			case <-ticker.C:
+				addrs = hook.reResolve(addrs, interval)
+			}
+		}
+	}()
+}
+
+// reResolve looks up the endpoint host, bounded by timeout, and recycles the pool if its addresses differ from last,
+// the previous answer (nil before the first). It returns the addresses to compare the next answer with, keeping last
+// when the lookup fails.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) reResolve(last []string, timeout time.Duration) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := hook.resolveHost(ctx, hook.host)
+	if err != nil {
+		hook.reportError(fmt.Errorf("unable to re-resolve %s | err: %w", hook.host, err))
+		return last
+	}
+
+	sort.Strings(addrs)
+	if last != nil && !slices.Equal(addrs, last) {
+		hook.recyclePool()
+	}
+	return addrs
+}
+
+// recyclePool closes the pooled connections, and those borrowed meanwhile once they're returned, so the next writes
+// dial afresh
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) recyclePool() {
+	hook.poolMutex.Lock()
+	defer hook.poolMutex.Unlock()
+	if hook.closed {
+		return
+	}
+
+	hook.poolGeneration.Add(1)
+	for n := len(hook.pool); n > 0; n-- {
+		select {
+		case idle := <-hook.pool:
+			_ = idle.Close()
+		default:
+			// taken by getConn meanwhile
+		}
+	}
+	if hook.httpClient != nil {
+		hook.httpClient.CloseIdleConnections()
+	}
+}
+
+// reResolvable reports whether the hook dials a host name that ReResolveInterval can look up, rather than an IP or a
+// host pinned with StaticHosts
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) reResolvable() bool {
+	if _, pinned := hook.staticHosts[hook.host]; pinned {
+		return false
+	}
+	return hook.host != "" && net.ParseIP(hook.host) == nil
+}
@@ -0,0 +1,75 @@
+package insightops_logrus
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReResolveRecyclesPool(t *testing.T) {
+	dialer := newPipeDialer()
+	hook := newHook("token ")
+	hook.connDialer = dialer
+	hook.host = "data.logs.insight.rapid7.com"
+	require.NoError(t, hook.applyOptions(&Opts{Priority: logrus.DebugLevel, OnError: func(error) {}}))
+	defer hook.FlushAndClose()
+
+	var mu sync.Mutex
+	answer := []string{"10.0.0.2", "10.0.0.1"}
+	hook.resolveHost = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), answer...), nil
+	}
+	hook.startReResolver(10 * time.Millisecond)
+	logger := newTestLogger(hook)
+
+	logger.Info("one")
+	<-dialer.lines
+	// the same addresses in another order don't recycle the pool
+	mu.Lock()
+	answer = []string{"10.0.0.1", "10.0.0.2"}
+	mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	logger.Info("two")
+	<-dialer.lines
+	assert.Equal(t, 1, dialer.dials, "the pooled connection is reused")
+
+	mu.Lock()
+	answer = []string{"10.0.0.3"}
+	mu.Unlock()
+	require.Eventually(t, func() bool { return hook.poolGeneration.Load() == 1 }, time.Second, time.Millisecond)
+	assert.Empty(t, hook.pool)
+	logger.Info("three")
+	<-dialer.lines
+	assert.Equal(t, 2, dialer.dials, "the write after the change dials afresh")
+}
+
+func TestRecycledConnNotReturned(t *testing.T) {
+	hook := newHook("token ")
+	defer hook.FlushAndClose()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	generation := hook.poolGeneration.Load()
+	hook.recyclePool()
+	hook.returnConn(client, generation)
+	assert.Empty(t, hook.pool, "a connection borrowed before the recycle is closed rather than pooled")
+}
+
+func TestReResolveSkipsPinnedHosts(t *testing.T) {
+	hook := newHook("token ")
+	hook.host = "data.logs.insight.rapid7.com"
+	assert.True(t, hook.reResolvable())
+
+	hook.staticHosts = map[string]string{hook.host: "10.0.0.1"}
+	assert.False(t, hook.reResolvable())
+
+	hook.host, hook.staticHosts = "127.0.0.1", nil
+	assert.False(t, hook.reResolvable())
+}
@@ -0,0 +1,86 @@
+package insightops_logrus
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+const selfTestField = "insightops_selftest"
+
+// SelfTest sends a uniquely tagged marker entry through the hook's full formatting and delivery path and reports
+// whether it was written without error. It checks the token, endpoint and formatting work together, beyond a plain
+// connection probe.
+// The token TCP endpoint has no acknowledgements and the hook doesn't query InsightOps back, so success means the
+// marker was accepted by the connection, not that it's searchable yet; search for the insightops_selftest field to
+// confirm ingestion. The marker bypasses the hook's level range and required-field checks.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) SelfTest(ctx context.Context) error {
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+
+	entry := &logrus.Entry{
+		Data:    logrus.Fields{selfTestField: id},
+		Time:    time.Now(),
+		Level:   logrus.InfoLevel,
+		Message: "insightops hook self-test",
+		Context: ctx,
+	}
+	line, err := hook.format(entry)
+	if err != nil {
+		return fmt.Errorf("self-test: unable to format marker: %w", err)
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if err = hook.writeLine(ctx, line, deadline); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("self-test: unable to write marker: %w", err)
+	}
+	return nil
+}
+
+// Ping checks the endpoint can be reached, e.g. for a readiness probe, without shipping anything. It dials a fresh
+// connection as deliveries would, TLS handshake and PROXY header included, within ctx's deadline, then closes it. The
+// pool, backoff and Stats are left untouched, but the connection counts against SetMaxTotalConnections while open. A
+// hook made by NewWithConn never dials, so Ping only checks it isn't closed.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) Ping(ctx context.Context) error {
+	if hook.isClosed() {
+		return ErrHookClosed
+	}
+	if hook.conn != nil {
+		return nil
+	}
+
+	ok, reserved := acquireConnSlot()
+	if !ok {
+		return fmt.Errorf("ping: %w", ErrTooManyConnections)
+	}
+	if reserved {
+		defer releaseConnSlot()
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn, err := hook.getConnDialer().dial(ctx, deadline)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if !deadline.IsZero() && isTimeout(err) {
+			// the connection's deadline is ctx's, and can pass a moment before ctx reports it
+			return fmt.Errorf("ping: unable to reach %s: %w: %w", hook.dialAddress(), context.DeadlineExceeded, err)
+		}
+		return fmt.Errorf("ping: unable to reach %s: %w", hook.dialAddress(), err)
+	}
+	return conn.Close()
+}
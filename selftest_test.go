@@ -0,0 +1,73 @@
+package insightops_logrus
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.ErrorLevel, RequiredFields: []string{"service"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, hook.SelfTest(ctx))
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "insightops hook self-test", payload["msg"])
+	assert.Regexp(t, `^[0-9a-f-]{36}$`, payload[selfTestField])
+
+	// unreachable endpoint
+	s.Stop()
+	drainPool(hook)
+	assert.Error(t, hook.SelfTest(ctx))
+
+	// cancelled context
+	cancel()
+	assert.ErrorIs(t, hook.SelfTest(ctx), context.Canceled)
+}
+
+func TestPing(t *testing.T) {
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, hook.Ping(ctx))
+	require.Eventually(t, func() bool { return s.Accepted() == 1 }, time.Second, time.Millisecond)
+	assert.Empty(t, hook.pool, "the ping connection isn't pooled")
+	assert.Equal(t, Stats{}, hook.Stats())
+
+	// closed port
+	s.Stop()
+	assert.ErrorContains(t, hook.Ping(ctx), "ping: unable to reach")
+
+	// a TLS endpoint that never completes the handshake is given up on at the context's deadline
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	hook.encrypt = true
+	hook.port = l.Addr().(*net.TCPAddr).Port
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	start := time.Now()
+	assert.ErrorIs(t, hook.Ping(short), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	hook.FlushAndClose()
+	assert.ErrorIs(t, hook.Ping(ctx), ErrHookClosed)
+}
@@ -0,0 +1,141 @@
+package insightops_logrus
+
+import (
+	"github.com/sirupsen/logrus"
+	"sync/atomic"
+)
+
+// Stats is a point-in-time snapshot of the hook's counters, covering delivery and explaining why entries didn't ship
+type Stats struct {
+	Sent         uint64 // entries written
+	Failed       uint64 // entries whose write failed, including those counted in DroppedDeadline and FellBack
+	FellBack     uint64 // entries written to Opts.Fallback after their write failed
+	Reconnects   uint64 // fresh connections dialed to retry a write after a pooled connection turned out dead, or timed out under WriteTimeoutRetry
+	Dropped      uint64 // entries discarded without being written; the sum of the Dropped counters other than DroppedDeadline
+	BytesWritten uint64 // bytes written for Sent entries, token included
+
+	FilteredByLevel       uint64 // entries fired at a level outside the hook's current range, see SetPriority
+	DroppedRequiredFields uint64 // entries dropped for missing one of Opts.RequiredFields
+	DroppedInvalidJSON    uint64 // entries dropped by Opts.ValidateJSON
+	DroppedDeadline       uint64 // entries dropped for missing Opts.FireDeadline
+	DroppedOverload       uint64 // entries dropped for exceeding Opts.MaxConcurrentFires
+	DroppedQueueFull      uint64 // entries dropped by Opts.QueueFullPolicy, including Block waits cut short by FireCtx's context or by FlushAndClose, or fired after it, in Opts.Async mode
+	DroppedShutdown       uint64 // entries still queued in Opts.Async mode when FlushAndCloseContext ran out of time
+	DroppedTransform      uint64 // entries Opts.TransformEntry returned nil for
+	DroppedRateLimit      uint64 // entries over Opts.MaxLinesPerSecond, or whose RateLimitBlock wait was cut short by FireCtx's context
+
+	BatchesFlushed            uint64 // batches written in Opts.BatchSize mode, whether or not the write succeeded; see BatchSizeCounts for their sizes
+	BatchedEntries            uint64 // entries in those batches, so BatchedEntries/BatchesFlushed is the mean batch size
+	BatchedBytes              uint64 // bytes in those batches, token included
+	BatchFlushesBySize        uint64 // batches written because they reached Opts.BatchSize
+	BatchFlushesByInterval    uint64 // batches written once Opts.BatchFlushInterval passed
+	BatchFlushesByShutdown    uint64 // batches written by FlushAndClose
+	BatchFlushesByMemPressure uint64 // batches written early by Opts.FlushOnMemPressure
+}
+
+// counters holds the live values behind Stats
+type counters struct {
+	sent         atomic.Uint64
+	failed       atomic.Uint64
+	fellBack     atomic.Uint64
+	reconnects   atomic.Uint64
+	bytesWritten atomic.Uint64
+
+	filteredByLevel       atomic.Uint64
+	droppedRequiredFields atomic.Uint64
+	droppedInvalidJSON    atomic.Uint64
+	droppedDeadline       atomic.Uint64
+	droppedOverload       atomic.Uint64
+	droppedQueueFull      atomic.Uint64
+	droppedShutdown       atomic.Uint64
+	droppedTransform      atomic.Uint64
+	droppedRateLimit      atomic.Uint64
+
+	// shippedByLevel is indexed by logrus.Level, which runs from PanicLevel (0) to TraceLevel
+	shippedByLevel [logrus.TraceLevel + 1]atomic.Uint64
+
+	batchesFlushed atomic.Uint64
+	batchedEntries atomic.Uint64
+	batchedBytes   atomic.Uint64
+	batchFlushes   [batchFlushReasons]atomic.Uint64
+	// batchSizes is indexed by entries per batch, from 0 to Opts.BatchSize; it's nil without batching
+	batchSizes []atomic.Uint64
+}
+
+// shipped counts an entry of level as delivered
+func (c *counters) shipped(level logrus.Level) {
+	if level <= logrus.TraceLevel {
+		c.shippedByLevel[level].Add(1)
+	}
+}
+
+// batchFlushed counts a batch of n entries and size bytes written for reason
+func (c *counters) batchFlushed(reason batchFlushReason, n int, size int) {
+	c.batchesFlushed.Add(1)
+	c.batchedEntries.Add(uint64(n))
+	c.batchedBytes.Add(uint64(size))
+	c.batchFlushes[reason].Add(1)
+	if n < len(c.batchSizes) {
+		c.batchSizes[n].Add(1)
+	}
+}
+
+// Stats returns a snapshot of the hook's counters
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) Stats() Stats {
+	stats := Stats{
+		Sent:         hook.counters.sent.Load(),
+		Failed:       hook.counters.failed.Load(),
+		FellBack:     hook.counters.fellBack.Load(),
+		Reconnects:   hook.counters.reconnects.Load(),
+		BytesWritten: hook.counters.bytesWritten.Load(),
+
+		FilteredByLevel:       hook.counters.filteredByLevel.Load(),
+		DroppedRequiredFields: hook.counters.droppedRequiredFields.Load(),
+		DroppedInvalidJSON:    hook.counters.droppedInvalidJSON.Load(),
+		DroppedDeadline:       hook.counters.droppedDeadline.Load(),
+		DroppedOverload:       hook.counters.droppedOverload.Load(),
+		DroppedQueueFull:      hook.counters.droppedQueueFull.Load(),
+		DroppedShutdown:       hook.counters.droppedShutdown.Load(),
+		DroppedTransform:      hook.counters.droppedTransform.Load(),
+		DroppedRateLimit:      hook.counters.droppedRateLimit.Load(),
+
+		BatchesFlushed:            hook.counters.batchesFlushed.Load(),
+		BatchedEntries:            hook.counters.batchedEntries.Load(),
+		BatchedBytes:              hook.counters.batchedBytes.Load(),
+		BatchFlushesBySize:        hook.counters.batchFlushes[flushedBySize].Load(),
+		BatchFlushesByInterval:    hook.counters.batchFlushes[flushedByInterval].Load(),
+		BatchFlushesByShutdown:    hook.counters.batchFlushes[flushedByShutdown].Load(),
+		BatchFlushesByMemPressure: hook.counters.batchFlushes[flushedByMemPressure].Load(),
+	}
+	stats.Dropped = stats.DroppedRequiredFields + stats.DroppedInvalidJSON + stats.DroppedOverload + stats.DroppedQueueFull +
+		stats.DroppedShutdown + stats.DroppedTransform + stats.DroppedRateLimit
+	return stats
+}
+
+// LevelCounts returns how many entries the hook has delivered at each level. Entries filtered out, dropped or that
+// failed to write aren't counted.
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) LevelCounts() map[logrus.Level]uint64 {
+	counts := make(map[logrus.Level]uint64, len(logrus.AllLevels))
+	for _, level := range logrus.AllLevels {
+		counts[level] = hook.counters.shippedByLevel[level].Load()
+	}
+	return counts
+}
+
+// BatchSizeCounts returns how many batches of each size (in entries) the hook has written in Opts.BatchSize mode,
+// leaving out sizes it hasn't written
+//
+//goland:noinspection GoMixedReceiverTypes
+func (hook *InsightOpsHook) BatchSizeCounts() map[int]uint64 {
+	counts := map[int]uint64{}
+	for size := range hook.counters.batchSizes {
+		if n := hook.counters.batchSizes[size].Load(); n > 0 {
+			counts[size] = n
+		}
+	}
+	return counts
+}
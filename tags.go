@@ -0,0 +1,75 @@
+package insightops_logrus
+
+import (
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"time"
+)
+
+// envTags returns a TagSource mapping each set environment variable to its field
+func envTags(fields map[string]string) TagSource {
+	return func() logrus.Fields {
+		tags := logrus.Fields{}
+		for env, field := range fields {
+			if v := os.Getenv(env); v != "" {
+				tags[field] = v
+			}
+		}
+		return tags
+	}
+}
+
+// KubernetesTags reads pod metadata exposed through the downward API as environment variables
+// (POD_NAME, POD_NAMESPACE, POD_IP and NODE_NAME)
+var KubernetesTags = envTags(map[string]string{
+	"POD_NAME":      "k8s_pod",
+	"POD_NAMESPACE": "k8s_namespace",
+	"POD_IP":        "k8s_pod_ip",
+	"NODE_NAME":     "k8s_node",
+})
+
+// AWSTags reads the region and runtime details AWS sets for Lambda, ECS and EC2 (when AWS_REGION is exported)
+var AWSTags = envTags(map[string]string{
+	"AWS_REGION":                    "aws_region",
+	"AWS_EXECUTION_ENV":             "aws_execution_env",
+	"AWS_LAMBDA_FUNCTION_NAME":      "aws_lambda_function",
+	"ECS_CONTAINER_METADATA_URI_V4": "aws_ecs_metadata_uri",
+})
+
+// GCPTags reads the service details Cloud Run and App Engine set
+var GCPTags = envTags(map[string]string{
+	"K_SERVICE":            "gcp_service",
+	"K_REVISION":           "gcp_revision",
+	"GOOGLE_CLOUD_PROJECT": "gcp_project",
+})
+
+// HostnameTag attaches the host name reported by the kernel
+func HostnameTag() logrus.Fields {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return nil
+	}
+	return logrus.Fields{"hostname": name}
+}
+
+// processStart approximates when the process started, as the time the package was initialised
+var processStart = time.Now()
+
+// bootIDProvider returns the host's boot id, or "" when the platform doesn't expose one. Swappable for tests.
+var bootIDProvider = func() string {
+	id, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+// bootTags returns the fields attached by Opts.AddBootID
+func bootTags() logrus.Fields {
+	tags := logrus.Fields{"process_start": processStart.UTC().Format(time.RFC3339Nano)}
+	if id := bootIDProvider(); id != "" {
+		tags["boot_id"] = id
+	}
+	return tags
+}
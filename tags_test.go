@@ -0,0 +1,33 @@
+package insightops_logrus
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAddBootID(t *testing.T) {
+	original := bootIDProvider
+	t.Cleanup(func() { bootIDProvider = original })
+	bootIDProvider = func() string { return "5c6b2f0e-8d1a-4c52-9e3b-0f2d7a1c9b44" }
+
+	s := newLineServer(t, nil)
+	hook := newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, AddBootID: true})
+	newTestLogger(hook).Info("booted")
+
+	payload := nextPayload(t, s)
+	assert.Equal(t, "5c6b2f0e-8d1a-4c52-9e3b-0f2d7a1c9b44", payload["boot_id"])
+	started, err := time.Parse(time.RFC3339Nano, payload["process_start"].(string))
+	assert.NoError(t, err)
+	assert.True(t, started.Equal(processStart))
+
+	// platforms without a boot id only get the start time
+	bootIDProvider = func() string { return "" }
+	hook = newTestHook(t, s, &Opts{Priority: logrus.DebugLevel, AddBootID: true})
+	newTestLogger(hook).Info("no boot id")
+
+	payload = nextPayload(t, s)
+	assert.NotContains(t, payload, "boot_id")
+	assert.Contains(t, payload, "process_start")
+}
@@ -0,0 +1,30 @@
+package insightops_logrus
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"slices"
+)
+
+// ErrCertificatePinMismatch fails dials whose server certificate isn't one of Opts.PinnedCertSHA256
+var ErrCertificatePinMismatch = errors.New("insightops: server certificate doesn't match any pinned SHA-256 fingerprint")
+
+const defaultMinTLSVersion = tls.VersionTLS12
+
+// pinCertificates makes config reject servers whose leaf certificate's SHA-256 isn't in pins, after (and in addition
+// to) any verification it already does
+func pinCertificates(config *tls.Config, pins [][32]byte) {
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		if len(state.PeerCertificates) == 0 || !slices.Contains(pins, sha256.Sum256(state.PeerCertificates[0].Raw)) {
+			return ErrCertificatePinMismatch
+		}
+		return nil
+	}
+}